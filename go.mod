@@ -3,26 +3,27 @@ module github.com/zymatik-com/importer
 go 1.21.5
 
 require (
+	github.com/brentp/irelate v0.0.1
 	github.com/brentp/vcfgo v0.0.0-20221128230736-759c0d32541e
 	github.com/cheggaaa/pb/v3 v3.1.4
+	github.com/jmoiron/sqlx v1.3.5
+	github.com/klauspost/compress v1.17.4
+	github.com/mattn/go-sqlite3 v1.14.19
 	github.com/urfave/cli/v2 v2.27.0
 	github.com/zymatik-com/genobase v0.5.0
 	github.com/zymatik-com/nucleo v0.1.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/Workiva/go-datastructures v1.1.1 // indirect
-	github.com/brentp/irelate v0.0.1 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.3 // indirect
 	github.com/fatih/color v1.15.0 // indirect
-	github.com/jmoiron/sqlx v1.3.5 // indirect
-	github.com/klauspost/compress v1.17.4 // indirect
 	github.com/klauspost/pgzip v1.2.6 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
-	github.com/mattn/go-sqlite3 v1.14.19 // indirect
 	github.com/pierrec/lz4/v4 v4.1.19 // indirect
 	github.com/pressly/goose/v3 v3.17.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
@@ -0,0 +1,381 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package bgzf reads BGZF (blocked gzip) compressed files, as produced by
+// bgzip, inflating blocks concurrently.
+package bgzf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// HeaderSize is the size of a (standard) BGZF block header, ie. a gzip
+	// header with a single BC extra subfield.
+	HeaderSize = 18
+	// MaxBlockSize is the maximum size of a BGZF block.
+	MaxBlockSize = 1 << 16
+	// The size of the fixed part of a gzip header.
+	gzipHeaderSize = 12
+	// The size of the gzip trailer (CRC32 and ISIZE).
+	trailerSize = 8
+	// The maximum number of blocks in flight, per worker.
+	blocksPerWorker = 4
+)
+
+// ErrNotBGZF is returned when the input contains a gzip member that isn't a
+// BGZF block.
+var ErrNotBGZF = errors.New("not a bgzf block")
+
+// IsBGZF reports whether b (the first HeaderSize bytes of a file) is the
+// start of a BGZF block.
+func IsBGZF(b []byte) bool {
+	if len(b) < gzipHeaderSize || !isGzipWithExtra(b) {
+		return false
+	}
+
+	xlen := int(binary.LittleEndian.Uint16(b[10:]))
+	if len(b) < gzipHeaderSize+xlen {
+		return false
+	}
+
+	_, ok := blockSize(b[gzipHeaderSize : gzipHeaderSize+xlen])
+	return ok
+}
+
+// VirtualOffset is a position within a BGZF file, the offset of a block
+// within the file and the offset of a byte within the (uncompressed) block.
+type VirtualOffset uint64
+
+// NewVirtualOffset returns the virtual offset of a byte within a block.
+func NewVirtualOffset(block int64, offset int) VirtualOffset {
+	return VirtualOffset(uint64(block)<<16 | uint64(offset))
+}
+
+// Block returns the file offset of the BGZF block.
+func (v VirtualOffset) Block() int64 {
+	return int64(v >> 16)
+}
+
+// Offset returns the offset within the uncompressed BGZF block.
+func (v VirtualOffset) Offset() int {
+	return int(v & 0xffff)
+}
+
+// Reader decompresses a BGZF stream, inflating up to workers blocks at once.
+type Reader struct {
+	// Progress, if set, is called with the compressed size of each block as
+	// its contents are first read.
+	Progress func(compressedSize int)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// The (pending) results of each block, in order.
+	queue chan chan block
+	buf   []byte
+	err   error
+
+	// The offsets of the blocks that have been read (for VirtualOffset), and
+	// of the end of the last one.
+	offsetsMu    sync.Mutex
+	offsets      []blockOffset
+	compressed   int64
+	uncompressed int64
+}
+
+// blockOffset is the position of a block in the compressed and decompressed
+// streams.
+type blockOffset struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// block is an inflated BGZF block.
+type block struct {
+	data           []byte
+	compressedSize int
+	err            error
+}
+
+// job is a BGZF block to inflate.
+type job struct {
+	raw    []byte
+	result chan<- block
+}
+
+// NewReader returns a reader decompressing the BGZF stream r, using the given
+// number of workers (or one per CPU if not positive).
+func NewReader(r io.Reader, workers int) *Reader {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	br := &Reader{
+		cancel: cancel,
+		queue:  make(chan chan block, workers*blocksPerWorker),
+	}
+
+	jobs := make(chan job, workers)
+
+	br.wg.Add(1)
+	go func() {
+		defer br.wg.Done()
+		defer close(jobs)
+		defer close(br.queue)
+
+		br.read(ctx, r, jobs)
+	}()
+
+	for i := 0; i < workers; i++ {
+		br.wg.Add(1)
+		go func() {
+			defer br.wg.Done()
+
+			fr := flate.NewReader(nil)
+			defer fr.Close()
+
+			for j := range jobs {
+				j.result <- inflate(fr, j.raw)
+			}
+		}()
+	}
+
+	return br
+}
+
+// Read reads decompressed data.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		result, ok := <-r.queue
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+
+		b := <-result
+		if b.err != nil {
+			r.err = b.err
+			continue
+		}
+
+		r.buf = b.data
+
+		r.offsetsMu.Lock()
+		r.offsets = append(r.offsets, blockOffset{compressed: r.compressed, uncompressed: r.uncompressed})
+		r.compressed += int64(b.compressedSize)
+		r.uncompressed += int64(len(b.data))
+		r.offsetsMu.Unlock()
+
+		if r.Progress != nil {
+			r.Progress(b.compressedSize)
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// VirtualOffset returns the virtual offset (relative to the start of the
+// stream) of a position in the decompressed stream. The position must be in a
+// block that has been read. To bound memory use, the offsets of any earlier
+// blocks are forgotten.
+func (r *Reader) VirtualOffset(pos int64) (VirtualOffset, bool) {
+	r.offsetsMu.Lock()
+	defer r.offsetsMu.Unlock()
+
+	i := sort.Search(len(r.offsets), func(i int) bool {
+		return r.offsets[i].uncompressed > pos
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+
+	end := r.uncompressed
+	if i+1 < len(r.offsets) {
+		end = r.offsets[i+1].uncompressed
+	}
+
+	// The end of the last block read can't be addressed until the next block
+	// has been read.
+	if pos >= end && pos > r.offsets[i].uncompressed {
+		return 0, false
+	}
+
+	r.offsets = r.offsets[i:]
+
+	return NewVirtualOffset(r.offsets[0].compressed, int(pos-r.offsets[0].uncompressed)), true
+}
+
+// Close stops decompressing, it does not close the underlying reader.
+func (r *Reader) Close() error {
+	r.cancel()
+	r.wg.Wait()
+
+	return nil
+}
+
+// read splits the stream into blocks, queuing them to be inflated.
+func (r *Reader) read(ctx context.Context, rd io.Reader, jobs chan<- job) {
+	for {
+		raw, err := readBlock(rd)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+
+		result := make(chan block, 1)
+		if err != nil {
+			result <- block{err: err}
+		}
+
+		select {
+		case r.queue <- result:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case jobs <- job{raw: raw, result: result}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readBlock reads a complete (compressed) BGZF block, returning io.EOF if
+// there are no more blocks.
+func readBlock(r io.Reader) ([]byte, error) {
+	header := make([]byte, gzipHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+
+		return nil, fmt.Errorf("could not read bgzf block header: %w", err)
+	}
+
+	if !isGzipWithExtra(header) {
+		return nil, ErrNotBGZF
+	}
+
+	xlen := int(binary.LittleEndian.Uint16(header[10:]))
+
+	size := gzipHeaderSize + xlen
+	raw := make([]byte, size, MaxBlockSize)
+	copy(raw, header)
+
+	if _, err := io.ReadFull(r, raw[gzipHeaderSize:]); err != nil {
+		return nil, fmt.Errorf("could not read bgzf block header: %w", err)
+	}
+
+	bsize, ok := blockSize(raw[gzipHeaderSize:])
+	if !ok {
+		return nil, ErrNotBGZF
+	}
+
+	if bsize < size+trailerSize || bsize > MaxBlockSize {
+		return nil, fmt.Errorf("invalid bgzf block size: %d", bsize)
+	}
+
+	raw = raw[:bsize]
+	if _, err := io.ReadFull(r, raw[size:]); err != nil {
+		return nil, fmt.Errorf("could not read bgzf block: %w", err)
+	}
+
+	return raw, nil
+}
+
+// inflate decompresses a BGZF block, checking its CRC.
+func inflate(fr io.ReadCloser, raw []byte) block {
+	b := block{compressedSize: len(raw)}
+
+	xlen := int(binary.LittleEndian.Uint16(raw[10:]))
+	trailer := raw[len(raw)-trailerSize:]
+	crc := binary.LittleEndian.Uint32(trailer)
+	isize := binary.LittleEndian.Uint32(trailer[4:])
+
+	if err := fr.(flate.Resetter).Reset(bytes.NewReader(raw[gzipHeaderSize+xlen:len(raw)-trailerSize]), nil); err != nil {
+		b.err = fmt.Errorf("could not inflate bgzf block: %w", err)
+		return b
+	}
+
+	if isize > MaxBlockSize {
+		b.err = fmt.Errorf("invalid bgzf block data size: %d", isize)
+		return b
+	}
+
+	b.data = make([]byte, isize)
+	if _, err := io.ReadFull(fr, b.data); err != nil {
+		b.err = fmt.Errorf("could not inflate bgzf block: %w", err)
+		return b
+	}
+
+	if crc32.ChecksumIEEE(b.data) != crc {
+		b.err = errors.New("bgzf block checksum mismatch")
+	}
+
+	return b
+}
+
+// isGzipWithExtra reports whether a gzip header is deflate compressed and has
+// extra subfields (as every BGZF block does).
+func isGzipWithExtra(header []byte) bool {
+	return header[0] == 0x1f && header[1] == 0x8b && header[2] == 8 && header[3]&0x04 != 0
+}
+
+// blockSize returns the total size of a BGZF block, given the extra subfields
+// of its header.
+func blockSize(extra []byte) (int, bool) {
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+slen {
+			return 0, false
+		}
+
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1, true
+		}
+
+		extra = extra[4+slen:]
+	}
+
+	return 0, false
+}
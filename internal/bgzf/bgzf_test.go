@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bgzf
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testBlock is a block written by writeBlocks.
+type testBlock struct {
+	compressed   int64
+	uncompressed int64
+	size         int
+}
+
+// writeBlocks writes each of data as a BGZF block, followed by an (empty) EOF
+// block, returning where the blocks start.
+func writeBlocks(t *testing.T, data ...[]byte) ([]byte, []testBlock) {
+	var buf bytes.Buffer
+	var blocks []testBlock
+	var uncompressed int64
+
+	for _, b := range append(data, nil) {
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		blocks = append(blocks, testBlock{compressed: int64(buf.Len()), uncompressed: uncompressed, size: len(b)})
+		uncompressed += int64(len(b))
+
+		header := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0, 0}
+		binary.LittleEndian.PutUint16(header[16:], uint16(HeaderSize+compressed.Len()+trailerSize-1))
+
+		buf.Write(header)
+		buf.Write(compressed.Bytes())
+		_ = binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(b))
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(b)))
+	}
+
+	return buf.Bytes(), blocks
+}
+
+// testData returns blocks of (partly compressible) test data, of varying
+// sizes including empty and full blocks.
+func testData() [][]byte {
+	rng := rand.New(rand.NewSource(1))
+
+	var data [][]byte
+	for _, size := range []int{1, 100, 0, 60000, 65280, 12345, 7} {
+		b := make([]byte, size)
+		for i := range b {
+			if i%3 == 0 {
+				b[i] = byte(rng.Intn(256))
+			} else {
+				b[i] = 'a' + byte(i%26)
+			}
+		}
+
+		data = append(data, b)
+	}
+
+	return data
+}
+
+func TestReader(t *testing.T) {
+	data := testData()
+	file, _ := writeBlocks(t, data...)
+	want := bytes.Join(data, nil)
+
+	// BGZF files are also valid (multi-member) gzip files.
+	zr, err := gzip.NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("gzip read %d bytes (%v), want %d", len(got), err, len(want))
+	}
+
+	for _, workers := range []int{1, 3, 0} {
+		r := NewReader(bytes.NewReader(file), workers)
+
+		var progress int
+		r.Progress = func(compressedSize int) {
+			progress += compressedSize
+		}
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d workers: read %d bytes, want %d", workers, len(got), len(want))
+		}
+
+		if progress != len(file) {
+			t.Errorf("%d workers: progress = %d, want %d", workers, progress, len(file))
+		}
+
+		_ = r.Close()
+	}
+}
+
+func TestReaderVirtualOffset(t *testing.T) {
+	data := testData()
+	file, blocks := writeBlocks(t, data...)
+
+	r := NewReader(bytes.NewReader(file), 2)
+	defer r.Close()
+
+	// The virtual offset of a position, found by the block holding it (the
+	// start of the next block, rather than the end of an earlier one).
+	want := func(pos int64) VirtualOffset {
+		for _, block := range blocks {
+			if pos < block.uncompressed+int64(block.size) {
+				return NewVirtualOffset(block.compressed, int(pos-block.uncompressed))
+			}
+		}
+
+		t.Fatalf("position %d is beyond the end of the test data", pos)
+		return 0
+	}
+
+	buf := make([]byte, 1000)
+
+	var pos int64
+	for {
+		n, err := r.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		// The positions of blocks which haven't been read are unknown.
+		if next := blocks[len(blocks)-2]; pos+int64(n) <= next.uncompressed {
+			if _, ok := r.VirtualOffset(next.uncompressed); ok {
+				t.Errorf("virtual offset of %d known before its block was read", next.uncompressed)
+			}
+		}
+
+		for _, p := range []int64{pos, pos + int64(n)/2, pos + int64(n) - 1} {
+			got, ok := r.VirtualOffset(p)
+			if !ok {
+				t.Fatalf("no virtual offset for %d", p)
+			}
+
+			if got != want(p) {
+				t.Errorf("virtual offset of %d = %d:%d, want %d:%d", p, got.Block(), got.Offset(), want(p).Block(), want(p).Offset())
+			}
+		}
+
+		pos += int64(n)
+	}
+
+	// Earlier blocks are forgotten.
+	if _, ok := r.VirtualOffset(0); ok {
+		t.Error("virtual offset of a forgotten block")
+	}
+}
+
+func TestVirtualOffset(t *testing.T) {
+	v := NewVirtualOffset(123456789, 65535)
+	if v.Block() != 123456789 || v.Offset() != 65535 {
+		t.Errorf("virtual offset = %d:%d, want 123456789:65535", v.Block(), v.Offset())
+	}
+
+	if NewVirtualOffset(1, 0) <= NewVirtualOffset(0, 65535) {
+		t.Error("virtual offsets aren't ordered by block")
+	}
+}
+
+func TestIsBGZF(t *testing.T) {
+	file, _ := writeBlocks(t, []byte("hello"))
+	if !IsBGZF(file[:HeaderSize]) {
+		t.Error("BGZF block not detected")
+	}
+
+	if IsBGZF(file[:HeaderSize-1]) {
+		t.Error("truncated header detected as BGZF")
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("hello"))
+	_ = zw.Close()
+
+	if IsBGZF(gz.Bytes()[:HeaderSize]) {
+		t.Error("gzip file detected as BGZF")
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	file, _ := writeBlocks(t, []byte("hello, world"))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("hello, world"))
+	_ = zw.Close()
+
+	corrupt := bytes.Clone(file)
+	// Flip a bit of the first block's CRC.
+	corrupt[int(binary.LittleEndian.Uint16(file[16:]))+1-trailerSize] ^= 1
+
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"gzip", gz.Bytes(), ErrNotBGZF},
+		{"checksum mismatch", corrupt, nil},
+		{"truncated", file[:len(file)/2], nil},
+		{"truncated header", file[:HeaderSize-2], nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(tt.file), 1)
+			defer r.Close()
+
+			_, err := io.ReadAll(r)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
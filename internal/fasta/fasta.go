@@ -0,0 +1,212 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fasta provides random access to (uncompressed) FASTA reference
+// sequences, using a samtools faidx index.
+package fasta
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// entry is a single sequence in a faidx index.
+type entry struct {
+	length    int64
+	offset    int64
+	lineBases int64
+	lineWidth int64
+}
+
+// Reader provides random access to the sequences of a FASTA file.
+type Reader struct {
+	f     *os.File
+	names []string
+	index map[string]entry
+}
+
+// Open opens a FASTA file, reading its index from "<path>.fai". If there is
+// no index one is built in memory (which requires reading the whole file).
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		f:     f,
+		index: make(map[string]entry),
+	}
+
+	magic := make([]byte, 2)
+	if _, err := f.ReadAt(magic, 0); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		_ = f.Close()
+		return nil, fmt.Errorf("compressed FASTA files are not supported")
+	}
+
+	idx, err := os.Open(path + ".fai")
+	if err == nil {
+		defer idx.Close()
+
+		err = r.readIndex(idx)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = r.buildIndex()
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not index FASTA file: %w", err)
+	}
+
+	return r, nil
+}
+
+// Close closes the FASTA file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// Names returns the names of the sequences in the FASTA file.
+func (r *Reader) Names() []string {
+	return r.names
+}
+
+// Sequence returns the (uppercase) bases of the named sequence in the
+// 1-based, inclusive range [start, end]. The range is clipped to the bounds
+// of the sequence. It is safe to call concurrently.
+func (r *Reader) Sequence(name string, start, end int64) ([]byte, error) {
+	e, ok := r.index[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sequence: %s", name)
+	}
+
+	start = max(start, 1)
+	end = min(end, e.length)
+	if start > end {
+		return nil, nil
+	}
+
+	from := e.byteOffset(start - 1)
+	to := e.byteOffset(end-1) + 1
+
+	buf := make([]byte, to-from)
+	if _, err := r.f.ReadAt(buf, from); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not read sequence: %w", err)
+	}
+
+	seq := buf[:0]
+	for _, b := range buf {
+		if b != '\n' && b != '\r' {
+			seq = append(seq, b)
+		}
+	}
+
+	return bytes.ToUpper(seq), nil
+}
+
+// byteOffset returns the file offset of the base at the given 0-based position.
+func (e entry) byteOffset(pos int64) int64 {
+	return e.offset + (pos/e.lineBases)*e.lineWidth + pos%e.lineBases
+}
+
+func (r *Reader) readIndex(rd io.Reader) error {
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+
+		var e entry
+		var err error
+		for i, v := range []*int64{&e.length, &e.offset, &e.lineBases, &e.lineWidth} {
+			if *v, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+				return fmt.Errorf("could not parse index entry for %s: %w", fields[0], err)
+			}
+		}
+
+		r.add(fields[0], e)
+	}
+
+	return scanner.Err()
+}
+
+func (r *Reader) buildIndex() error {
+	br := bufio.NewReaderSize(io.NewSectionReader(r.f, 0, 1<<62), 1<<20)
+
+	var name string
+	var e entry
+	var offset int64
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			width := int64(len(line))
+			bases := int64(len(strings.TrimRight(line, "\r\n")))
+
+			if strings.HasPrefix(line, ">") {
+				if name != "" {
+					r.add(name, e)
+				}
+
+				name = ""
+				if fields := strings.Fields(line[1:]); len(fields) > 0 {
+					name = fields[0]
+				}
+				e = entry{offset: offset + width}
+			} else if name != "" {
+				if e.lineBases == 0 {
+					e.lineBases = bases
+					e.lineWidth = width
+				}
+
+				e.length += bases
+			}
+
+			offset += width
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return err
+		}
+	}
+
+	if name != "" {
+		r.add(name, e)
+	}
+
+	return nil
+}
+
+func (r *Reader) add(name string, e entry) {
+	if e.lineBases == 0 {
+		e.lineBases, e.lineWidth = 1, 1
+	}
+
+	r.names = append(r.names, name)
+	r.index[name] = e
+}
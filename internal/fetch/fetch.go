@@ -0,0 +1,410 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fetch downloads remote input files into a local cache, so they are
+// only downloaded again when they change.
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// IsURL returns whether s is a URL (rather than a local path).
+func IsURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https", "file":
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultDir returns the default cache directory.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "zymatik-importer")
+}
+
+// Cache is a directory of downloaded files.
+//
+// Files are stored by the SHA-256 digest of their contents, as
+// <dir>/blobs/<digest>/<name> (so they keep the name they had on the server).
+// The version (ETag and Last-Modified) of each URL is recorded in
+// <dir>/urls/<digest of url>.json, and incomplete downloads are kept in
+// <dir>/partial until they can be resumed.
+type Cache struct {
+	dir          string
+	logger       *slog.Logger
+	client       *http.Client
+	showProgress bool
+}
+
+// New opens a cache directory, creating it if necessary.
+func New(logger *slog.Logger, dir string, showProgress bool) (*Cache, error) {
+	for _, subdir := range []string{"blobs", "urls", "partial"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0o755); err != nil {
+			return nil, fmt.Errorf("could not create cache directory: %w", err)
+		}
+	}
+
+	return &Cache{
+		dir:          dir,
+		logger:       logger,
+		client:       http.DefaultClient,
+		showProgress: showProgress,
+	}, nil
+}
+
+// entry records a downloaded (or partially downloaded) file.
+type entry struct {
+	URL          string `json:"url"`
+	Name         string `json:"name"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Size and SHA256 are only set once the download is complete.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Fetch returns the local path of the file at a URL, downloading it unless an
+// unchanged copy is already cached. Interrupted downloads are resumed (if the
+// server supports range requests).
+func (c *Cache) Fetch(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return filepath.FromSlash(u.Path), nil
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+	}
+
+	key := digest(rawURL)
+	urlPath := filepath.Join(c.dir, "urls", key+".json")
+	partialPath := filepath.Join(c.dir, "partial", key)
+
+	cached, err := readEntry(urlPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The cached file may have been removed to free up space.
+	if cached != nil {
+		if _, err := os.Stat(c.blobPath(cached)); err != nil {
+			cached = nil
+		}
+	}
+
+	partial, err := readEntry(partialPath + ".json")
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+
+	var offset int64
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	} else if partial != nil && partial.validator() != "" {
+		if fi, err := os.Stat(partialPath); err == nil && fi.Size() > 0 {
+			offset = fi.Size()
+
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", partial.validator())
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not download %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case cached != nil && resp.StatusCode == http.StatusNotModified:
+		c.logger.Info("Using cached download", "url", rawURL)
+
+		return c.blobPath(cached), nil
+	case cached != nil && resp.StatusCode == http.StatusOK && cached.sameVersion(resp.Header):
+		// The server ignored the conditional request.
+		c.logger.Info("Using cached download", "url", rawURL)
+
+		return c.blobPath(cached), nil
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return "", err
+		}
+
+		if start != offset {
+			return "", fmt.Errorf("server resumed download of %s at %d, expected %d", rawURL, start, offset)
+		}
+
+		c.logger.Info("Resuming download", "url", rawURL, "offset", offset)
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial download is no longer a prefix of the file (or is
+		// already complete), so start again.
+		if err := os.Remove(partialPath + ".json"); err != nil {
+			return "", fmt.Errorf("could not remove partial download: %w", err)
+		}
+
+		return c.Fetch(ctx, rawURL)
+	case resp.StatusCode == http.StatusOK:
+		// The file changed since the partial download, or the server doesn't
+		// support range requests.
+		offset = 0
+
+		c.logger.Info("Downloading", "url", rawURL)
+	default:
+		return "", fmt.Errorf("could not download %s: %s", rawURL, resp.Status)
+	}
+
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "download"
+	}
+
+	e := &entry{
+		URL:          rawURL,
+		Name:         name,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	// Record the version being downloaded, so an interrupted download can be
+	// resumed.
+	if err := writeEntry(partialPath+".json", e); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if err := c.download(partialPath, offset, h, resp); err != nil {
+		return "", fmt.Errorf("could not download %s: %w", rawURL, err)
+	}
+
+	fi, err := os.Stat(partialPath)
+	if err != nil {
+		return "", fmt.Errorf("could not get file info: %w", err)
+	}
+
+	e.Size = fi.Size()
+	e.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	blobPath := c.blobPath(e)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return "", fmt.Errorf("could not create cache directory: %w", err)
+	}
+
+	if err := os.Rename(partialPath, blobPath); err != nil {
+		return "", fmt.Errorf("could not add download to cache: %w", err)
+	}
+
+	if err := writeEntry(urlPath, e); err != nil {
+		return "", err
+	}
+
+	if err := os.Remove(partialPath + ".json"); err != nil {
+		return "", fmt.Errorf("could not remove partial download: %w", err)
+	}
+
+	return blobPath, nil
+}
+
+// download writes the body of a response to a (partial) file, starting at
+// offset, and hashes the whole file.
+func (c *Cache) download(partialPath string, offset int64, h hash.Hash, resp *http.Response) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+
+		// Hash what we already have.
+		f, err := os.Open(partialPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(h, f, offset)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("could not read partial download: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(partialPath, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = resp.Body
+	if c.showProgress {
+		var total int64
+		if resp.ContentLength > 0 {
+			total = offset + resp.ContentLength
+		}
+
+		bar := pb.Full.Start64(total)
+		bar.Set(pb.Bytes, true)
+		bar.Set("prefix", path.Base(resp.Request.URL.Path)+" ")
+		bar.SetCurrent(offset)
+		defer bar.Finish()
+
+		r = bar.NewProxyReader(r)
+	}
+
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return err
+	}
+
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("download incomplete, got %d of %d bytes", n, resp.ContentLength)
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// blobPath returns the path of a downloaded file in the cache.
+func (c *Cache) blobPath(e *entry) string {
+	return filepath.Join(c.dir, "blobs", e.SHA256, e.Name)
+}
+
+// validator returns the validator used to resume a download (If-Range
+// requires a strong ETag).
+func (e *entry) validator() string {
+	if e.ETag != "" && !strings.HasPrefix(e.ETag, "W/") {
+		return e.ETag
+	}
+
+	return e.LastModified
+}
+
+// sameVersion returns whether a response is for the same version of a file.
+func (e *entry) sameVersion(header http.Header) bool {
+	if etag := header.Get("ETag"); etag != "" || e.ETag != "" {
+		return etag == e.ETag
+	}
+
+	lastModified := header.Get("Last-Modified")
+
+	return lastModified != "" && lastModified == e.LastModified
+}
+
+// contentRangeStart returns the first byte of a Content-Range, eg.
+// "bytes 100-199/200".
+func contentRangeStart(contentRange string) (int64, error) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range: %q", contentRange)
+	}
+
+	start, _, _ := strings.Cut(spec, "-")
+
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid content range: %q", contentRange)
+	}
+
+	return n, nil
+}
+
+// readEntry reads a cache entry, returning nil if there isn't one.
+func readEntry(path string) (*entry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read cache entry: %w", err)
+	}
+
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("could not decode cache entry %s: %w", path, err)
+	}
+
+	return &e, nil
+}
+
+// writeEntry atomically writes a cache entry.
+func writeEntry(path string, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode cache entry: %w", err)
+	}
+
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("could not write cache entry: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("could not write cache entry: %w", err)
+	}
+
+	return nil
+}
+
+// digest returns the hex encoded SHA-256 digest of a string.
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,271 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves a single file, which can be changed between requests.
+type testServer struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	content      []byte
+	etag         string
+	lastModified time.Time
+	// The number of bytes to send before dropping the connection (for the
+	// next response only).
+	interruptAfter int
+	// The requests received.
+	requests []*http.Request
+}
+
+func newTestServer(t *testing.T, content []byte, etag string) *testServer {
+	s := &testServer{
+		content:      content,
+		etag:         etag,
+		lastModified: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(context.Background()))
+	content, etag, lastModified := s.content, s.etag, s.lastModified
+	interruptAfter := s.interruptAfter
+	s.interruptAfter = 0
+	s.mu.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if interruptAfter > 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		_, _ = w.Write(content[:interruptAfter])
+
+		// Returning having written less than the Content-Length closes the
+		// connection.
+		return
+	}
+
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(content))
+}
+
+// update changes the file being served.
+func (s *testServer) update(content []byte, etag string, lastModified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = content
+	s.etag = etag
+	s.lastModified = lastModified
+}
+
+// interrupt drops the connection of the next response after n bytes.
+func (s *testServer) interrupt(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.interruptAfter = n
+}
+
+// lastRequest returns the most recent request received.
+func (s *testServer) lastRequest() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[len(s.requests)-1]
+}
+
+func newTestCache(t *testing.T) *Cache {
+	c, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func fetch(t *testing.T, c *Cache, url string, want []byte) string {
+	t.Helper()
+
+	path, err := c.Fetch(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("fetched %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	return path
+}
+
+func TestFetchCache(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	s := newTestServer(t, content, `"v1"`)
+	c := newTestCache(t)
+
+	url := s.URL + "/release/file.vcf.gz"
+
+	// A miss downloads the file, keeping its name.
+	path := fetch(t, c, url, content)
+	if name := filepath.Base(path); name != "file.vcf.gz" {
+		t.Errorf("cached as %q, want file.vcf.gz", name)
+	}
+
+	if header := s.lastRequest().Header.Get("If-None-Match"); header != "" {
+		t.Errorf("miss sent If-None-Match %q", header)
+	}
+
+	// A hit revalidates, and the server has nothing new to send.
+	if got := fetch(t, c, url, content); got != path {
+		t.Errorf("hit returned %s, want %s", got, path)
+	}
+
+	if header := s.lastRequest().Header.Get("If-None-Match"); header != `"v1"` {
+		t.Errorf("hit sent If-None-Match %q, want \"v1\"", header)
+	}
+
+	// Removing the cached file (eg. to free up space) is a miss.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch(t, c, url, content)
+
+	if header := s.lastRequest().Header.Get("If-None-Match"); header != "" {
+		t.Errorf("miss sent If-None-Match %q", header)
+	}
+}
+
+func TestFetchRevalidate(t *testing.T) {
+	t.Run("ETag", func(t *testing.T) {
+		s := newTestServer(t, []byte("version 1"), `"v1"`)
+		c := newTestCache(t)
+
+		path := fetch(t, c, s.URL+"/file.tsv", []byte("version 1"))
+
+		s.update([]byte("version 2"), `"v2"`, s.lastModified)
+
+		if got := fetch(t, c, s.URL+"/file.tsv", []byte("version 2")); got == path {
+			t.Errorf("changed file cached at the same path %s", got)
+		}
+	})
+
+	t.Run("Last-Modified", func(t *testing.T) {
+		s := newTestServer(t, []byte("version 1"), "")
+		c := newTestCache(t)
+
+		path := fetch(t, c, s.URL+"/file.tsv", []byte("version 1"))
+
+		if got := fetch(t, c, s.URL+"/file.tsv", []byte("version 1")); got != path {
+			t.Errorf("unchanged file returned %s, want %s", got, path)
+		}
+
+		if header := s.lastRequest().Header.Get("If-Modified-Since"); header != "Mon, 01 Jan 2024 00:00:00 GMT" {
+			t.Errorf("sent If-Modified-Since %q", header)
+		}
+
+		s.update([]byte("version 2"), "", s.lastModified.Add(time.Hour))
+
+		fetch(t, c, s.URL+"/file.tsv", []byte("version 2"))
+	})
+}
+
+func TestFetchResume(t *testing.T) {
+	content := bytes.Repeat([]byte("abcdefghij"), 10000)
+	s := newTestServer(t, content, `"v1"`)
+	c := newTestCache(t)
+
+	url := s.URL + "/file.vcf.gz"
+
+	s.interrupt(12345)
+	if _, err := c.Fetch(context.Background(), url); err == nil {
+		t.Fatal("interrupted download succeeded")
+	}
+
+	fetch(t, c, url, content)
+
+	req := s.lastRequest()
+	if header := req.Header.Get("Range"); header != "bytes=12345-" {
+		t.Errorf("resumed with Range %q, want bytes=12345-", header)
+	}
+
+	if header := req.Header.Get("If-Range"); header != `"v1"` {
+		t.Errorf("resumed with If-Range %q, want \"v1\"", header)
+	}
+}
+
+func TestFetchResumeChanged(t *testing.T) {
+	s := newTestServer(t, []byte(strings.Repeat("a", 1000)), `"v1"`)
+	c := newTestCache(t)
+
+	url := s.URL + "/file.vcf.gz"
+
+	s.interrupt(100)
+	if _, err := c.Fetch(context.Background(), url); err == nil {
+		t.Fatal("interrupted download succeeded")
+	}
+
+	// The partial download is of an old version, so is started again.
+	content := []byte(strings.Repeat("b", 2000))
+	s.update(content, `"v2"`, s.lastModified)
+
+	fetch(t, c, url, content)
+}
+
+func TestIsURL(t *testing.T) {
+	for s, want := range map[string]bool{
+		"https://ftp.ncbi.nih.gov/snp/latest_release/VCF/GCF_000001405.40.gz": true,
+		"http://example.com/file.tsv":                                         true,
+		"file:///data/file.tsv":                                               true,
+		"/data/file.tsv":                                                      false,
+		"data/*.vcf.gz":                                                       false,
+	} {
+		if got := IsURL(s); got != want {
+			t.Errorf("IsURL(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"cmp"
+	"strconv"
+
+	"github.com/zymatik-com/genobase/types"
+	"github.com/zymatik-com/importer/internal/store"
+	"github.com/zymatik-com/nucleo/names"
+)
+
+// interval is a 1-based, inclusive range of positions on a chromosome.
+type interval struct {
+	start, end uint64
+}
+
+func (r interval) contains(pos uint64) bool {
+	return pos >= r.start && pos <= r.end
+}
+
+// assembly describes the RefSeq accessions and pseudo-autosomal regions of a
+// reference genome assembly.
+type assembly struct {
+	// RefSeq accession to chromosome name.
+	chromosomes map[string]string
+	// Pseudo-autosomal regions, keyed by chromosome (X or Y).
+	par1, par2 map[string]interval
+}
+
+var assemblies = map[types.Reference]*assembly{
+	types.ReferenceGRCh37: {
+		chromosomes: map[string]string{
+			"NC_000001.10": "1",
+			"NC_000002.11": "2",
+			"NC_000003.11": "3",
+			"NC_000004.11": "4",
+			"NC_000005.9":  "5",
+			"NC_000006.11": "6",
+			"NC_000007.13": "7",
+			"NC_000008.10": "8",
+			"NC_000009.11": "9",
+			"NC_000010.10": "10",
+			"NC_000011.9":  "11",
+			"NC_000012.11": "12",
+			"NC_000013.10": "13",
+			"NC_000014.8":  "14",
+			"NC_000015.9":  "15",
+			"NC_000016.9":  "16",
+			"NC_000017.10": "17",
+			"NC_000018.9":  "18",
+			"NC_000019.9":  "19",
+			"NC_000020.10": "20",
+			"NC_000021.8":  "21",
+			"NC_000022.10": "22",
+			"NC_000023.10": "X",
+			"NC_000024.9":  "Y",
+			"NC_012920.1":  "MT",
+		},
+		par1: map[string]interval{
+			"X": {60001, 2699520},
+			"Y": {10001, 2649520},
+		},
+		par2: map[string]interval{
+			"X": {154931044, 155260560},
+			"Y": {59034050, 59363566},
+		},
+	},
+	types.ReferenceGRCh38: {
+		chromosomes: map[string]string{
+			"NC_000001.11": "1",
+			"NC_000002.12": "2",
+			"NC_000003.12": "3",
+			"NC_000004.12": "4",
+			"NC_000005.10": "5",
+			"NC_000006.12": "6",
+			"NC_000007.14": "7",
+			"NC_000008.11": "8",
+			"NC_000009.12": "9",
+			"NC_000010.11": "10",
+			"NC_000011.10": "11",
+			"NC_000012.12": "12",
+			"NC_000013.11": "13",
+			"NC_000014.9":  "14",
+			"NC_000015.10": "15",
+			"NC_000016.10": "16",
+			"NC_000017.11": "17",
+			"NC_000018.10": "18",
+			"NC_000019.10": "19",
+			"NC_000020.11": "20",
+			"NC_000021.9":  "21",
+			"NC_000022.11": "22",
+			"NC_000023.11": "X",
+			"NC_000024.10": "Y",
+			"NC_012920.1":  "MT",
+		},
+		par1: map[string]interval{
+			"X": {10001, 2781479},
+			"Y": {10001, 2781479},
+		},
+		par2: map[string]interval{
+			"X": {155701383, 156030895},
+			"Y": {56887903, 57217415},
+		},
+	},
+}
+
+// pseudoAutosomalRegion returns the pseudo-autosomal region (PAR or PAR2)
+// a position falls within, or an empty string if it is not within one.
+func (a *assembly) pseudoAutosomalRegion(chromosome string, pos uint64) string {
+	if r, ok := a.par1[chromosome]; ok && r.contains(pos) {
+		return "PAR"
+	}
+
+	if r, ok := a.par2[chromosome]; ok && r.contains(pos) {
+		return "PAR2"
+	}
+
+	return ""
+}
+
+// locus returns the Genobase locus of a position on a (possibly chr prefixed)
+// chromosome, remapping pseudo-autosomal regions like the variants import.
+// Pseudo-autosomal positions on the Y chromosome have no locus, as only their
+// X chromosome copies are imported.
+func (a *assembly) locus(chromosome string, pos int64) *store.Locus {
+	chromosome = a.contigName(chromosome)
+	if par := a.pseudoAutosomalRegion(chromosome, uint64(pos)); par != "" {
+		if chromosome == "Y" {
+			return nil
+		}
+
+		chromosome = par
+	}
+
+	return &store.Locus{Chromosome: chromosome, Position: pos}
+}
+
+// contigName returns the chromosome name of a contig, given either its RefSeq
+// accession or a (possibly chr prefixed) chromosome name.
+func (a *assembly) contigName(contig string) string {
+	if chromosome, ok := a.chromosomes[contig]; ok {
+		return chromosome
+	}
+
+	return names.Chromosome(contig)
+}
+
+// chromosomeOrder returns a sort key for a chromosome, putting them in
+// karyotypic order (1-22, X, Y, MT) followed by any other contigs by name.
+func chromosomeOrder(chromosome string) (int, string) {
+	name := names.Chromosome(chromosome)
+	if n, err := strconv.Atoi(name); err == nil && n > 0 && n <= 22 {
+		return n, ""
+	}
+
+	switch name {
+	case "X":
+		return 23, ""
+	case "Y":
+		return 24, ""
+	case "MT":
+		return 25, ""
+	default:
+		return 26, name
+	}
+}
+
+// compareLoci compares two chromosome positions, using chromosomeOrder.
+func compareLoci(chromosomeA string, posA uint64, chromosomeB string, posB uint64) int {
+	orderA, nameA := chromosomeOrder(chromosomeA)
+	orderB, nameB := chromosomeOrder(chromosomeB)
+
+	if c := cmp.Compare(orderA, orderB); c != 0 {
+		return c
+	}
+
+	if c := cmp.Compare(nameA, nameB); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(posA, posB)
+}
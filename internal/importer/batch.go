@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"log/slog"
+	"time"
+)
+
+// DefaultBatchSize is the default number of rows stored per transaction.
+const DefaultBatchSize = 1000
+
+const (
+	// Adaptive batching aims to commit a batch about this often.
+	targetCommitLatency = 500 * time.Millisecond
+	// The limits of adaptive batch sizes.
+	minBatchSize = 100
+	maxBatchSize = 1000000
+	// The approximate size of a row, less its string columns (numeric
+	// columns, and SQLite's per row overhead).
+	rowOverhead = 64
+)
+
+// BatchOptions control how many rows are stored per transaction.
+type BatchOptions struct {
+	// Size is the maximum number of rows per batch (or the initial number,
+	// if adaptive). Defaults to DefaultBatchSize.
+	Size int
+	// Bytes is the approximate maximum size of a batch (unlimited if not
+	// positive).
+	Bytes int64
+	// Adaptive tunes the batch size from the observed commit latency.
+	Adaptive bool
+}
+
+// batcher decides when a batch of rows should be stored.
+type batcher struct {
+	logger *slog.Logger
+	opts   BatchOptions
+	// The current maximum number of rows per batch.
+	size int
+	// The rows, and approximate bytes, in the current batch.
+	rows  int
+	bytes int64
+}
+
+func newBatcher(logger *slog.Logger, opts BatchOptions) *batcher {
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	return &batcher{
+		logger: logger,
+		opts:   opts,
+		size:   size,
+	}
+}
+
+// add records that rows of (approximately) the given size were added to the
+// batch.
+func (b *batcher) add(rows int, bytes int) {
+	b.rows += rows
+	b.bytes += int64(bytes)
+}
+
+// full returns whether the batch should be stored.
+func (b *batcher) full() bool {
+	return b.rows >= b.size || (b.opts.Bytes > 0 && b.bytes >= b.opts.Bytes)
+}
+
+// store stores the batch, starting a new one.
+func (b *batcher) store(fn func() error) error {
+	start := time.Now()
+	if err := fn(); err != nil {
+		return err
+	}
+
+	if b.opts.Adaptive {
+		b.adapt(time.Since(start))
+	}
+
+	b.reset()
+
+	return nil
+}
+
+// reset starts a new batch (without storing the current one).
+func (b *batcher) reset() {
+	b.rows = 0
+	b.bytes = 0
+}
+
+// adapt tunes the batch size, given how long the current batch took to
+// store. The size only grows if the batch was limited by it (as opposed to
+// the number of bytes, or the end of the input).
+func (b *batcher) adapt(latency time.Duration) {
+	size := b.size
+	if latency > targetCommitLatency {
+		size = max(size/2, minBatchSize)
+	} else if latency < targetCommitLatency/2 && b.rows >= b.size {
+		size = min(size*2, maxBatchSize)
+	}
+
+	if size != b.size {
+		b.logger.Debug("Adjusting batch size", "size", size, "rows", b.rows, "latency", latency)
+		b.size = size
+	}
+}
+
+// approximateRowBytes approximates the size of a row with the given string
+// columns.
+func approximateRowBytes(columns ...string) int {
+	n := rowOverhead
+	for _, column := range columns {
+		n += len(column)
+	}
+
+	return n
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// errorBudget limits the number of malformed records an import will skip,
+// before giving up on the file.
+type errorBudget struct {
+	logger *slog.Logger
+	path   string
+	// The number of malformed records to skip (negative for no limit).
+	max   int64
+	stats *Stats
+
+	mu    sync.Mutex
+	count int64
+}
+
+// newErrorBudget returns the error budget of a file. In strict mode no
+// malformed records are skipped, otherwise up to maxErrors are (if positive).
+func newErrorBudget(logger *slog.Logger, path string, strict bool, maxErrors int, stats *Stats) *errorBudget {
+	b := &errorBudget{
+		logger: logger,
+		path:   path,
+		max:    -1,
+		stats:  stats,
+	}
+
+	if strict {
+		b.max = 0
+	} else if maxErrors > 0 {
+		b.max = int64(maxErrors)
+	}
+
+	return b
+}
+
+// read records that a record was read.
+func (b *errorBudget) read() {
+	b.stats.read()
+}
+
+// malformed records that the record (with the given fields) at a line is
+// malformed. It returns an error once the budget has been exhausted.
+func (b *errorBudget) malformed(lineNumber int64, fields [][]byte, err error) error {
+	field := func(i int) string {
+		if i < len(fields) {
+			return string(fields[i])
+		}
+
+		return ""
+	}
+
+	pos, _ := strconv.ParseUint(field(1), 10, 64)
+	b.stats.skipRecord(field(0), pos, field(2), field(3), field(4), skipMalformed)
+
+	b.mu.Lock()
+	b.count++
+	count := b.count
+	b.mu.Unlock()
+
+	if b.max >= 0 && count > b.max {
+		if b.max == 0 {
+			return fmt.Errorf("malformed record in %s at line %d: %w", b.path, lineNumber, err)
+		}
+
+		return fmt.Errorf("too many malformed records in %s (more than %d), at line %d: %w", b.path, b.max, lineNumber, err)
+	}
+
+	// Don't flood the log, the total is logged once the file has been read.
+	if count == 1 {
+		b.logger.Warn("Skipping malformed record", "path", b.path, "line", lineNumber, "error", err)
+	} else {
+		b.logger.Debug("Skipping malformed record", "path", b.path, "line", lineNumber, "error", err)
+	}
+
+	return nil
+}
+
+// finish warns about the malformed records skipped without a limit (as the
+// first of them is the only one logged as a warning, they'd be easy to miss).
+func (b *errorBudget) finish() {
+	b.mu.Lock()
+	count := b.count
+	b.mu.Unlock()
+
+	if b.max < 0 && count > 0 {
+		b.logger.Warn("Skipped malformed records", "path", b.path, "count", count)
+	}
+}
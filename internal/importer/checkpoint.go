@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/zymatik-com/importer/internal/bgzf"
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+const (
+	// The name of dbSNP variant import checkpoints.
+	variantsImport = "variants"
+)
+
+// checkpointer records how much of a file has been imported after each
+// committed batch of records. A nil *checkpointer records nothing.
+type checkpointer struct {
+	st         *store.DB
+	in         *input
+	checkpoint store.Checkpoint
+}
+
+// openCheckpointed opens an input file for an import that records
+// checkpoints. If resume is set, and the file has a checkpoint, the input
+// starts after the last committed record. A nil input is returned if the file
+// has already been completely imported.
+func openCheckpointed(ctx context.Context, logger *slog.Logger, st *store.DB, importName, path string, resume bool, progress *Progress) (*input, *checkpointer, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get absolute path: %w", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get file info: %w", err)
+	}
+
+	c := &checkpointer{
+		st: st,
+		checkpoint: store.Checkpoint{
+			Import:     importName,
+			Path:       absPath,
+			Size:       fi.Size(),
+			ModifiedAt: fi.ModTime().UnixNano(),
+		},
+	}
+
+	var checkpoint *store.Checkpoint
+	if resume {
+		var ok bool
+		checkpoint, ok, err = st.Checkpoint(ctx, importName, absPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !ok {
+			logger.Info("No checkpoint to resume from, importing the whole file", "path", path)
+		}
+	}
+
+	if checkpoint == nil {
+		c.in, err = openInput(ctx, path, progress)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return c.in, c, nil
+	}
+
+	if checkpoint.Size != c.checkpoint.Size || checkpoint.ModifiedAt != c.checkpoint.ModifiedAt {
+		return nil, nil, fmt.Errorf("%s has changed since its checkpoint, it can't be resumed", path)
+	}
+
+	if checkpoint.Completed {
+		logger.Info("Skipping already imported file", "path", path)
+
+		return nil, nil, nil
+	}
+
+	logger.Info("Resuming import from checkpoint", "path", path, "offset", checkpoint.ByteOffset, "lastRecord", checkpoint.LastRecord)
+
+	var virtualOffset *bgzf.VirtualOffset
+	if checkpoint.VirtualOffset != nil {
+		v := bgzf.VirtualOffset(*checkpoint.VirtualOffset)
+		virtualOffset = &v
+	}
+
+	c.in, err = openInputAt(ctx, path, checkpoint.ByteOffset, virtualOffset, progress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.in, c, nil
+}
+
+// save records that every record up to offset (in the input), ending with
+// lastRecord, has been committed.
+func (c *checkpointer) save(ctx context.Context, offset int64, lastRecord string) error {
+	if c == nil {
+		return nil
+	}
+
+	byteOffset, virtualOffset, ok := c.in.position(offset)
+	if !ok {
+		return nil
+	}
+
+	c.checkpoint.ByteOffset = byteOffset
+	c.checkpoint.VirtualOffset = nil
+	if virtualOffset != nil {
+		v := int64(*virtualOffset)
+		c.checkpoint.VirtualOffset = &v
+	}
+	c.checkpoint.LastRecord = lastRecord
+
+	return c.st.SetCheckpoint(ctx, &c.checkpoint)
+}
+
+// complete records that the whole file has been imported.
+func (c *checkpointer) complete(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+
+	c.checkpoint.Completed = true
+
+	return c.st.SetCheckpoint(ctx, &c.checkpoint)
+}
+
+// deleteCheckpoints deletes any checkpoints of a file, so its import can't be
+// resumed.
+func deleteCheckpoints(ctx context.Context, st *store.DB, path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("could not get absolute path: %w", err)
+	}
+
+	return st.DeleteCheckpoints(ctx, absPath)
+}
+
+// openInputAt opens a VCF at an offset in the decompressed file (the end of a
+// record), preceded by its header lines. Given the BGZF virtual offset of the
+// same position we can seek straight to it, otherwise the file is
+// decompressed up to the offset.
+func openInputAt(ctx context.Context, path string, offset int64, virtualOffset *bgzf.VirtualOffset, progress *Progress) (*input, error) {
+	if virtualOffset == nil {
+		in, err := openInput(ctx, path, progress)
+		if err != nil {
+			return nil, err
+		}
+
+		br := bufio.NewReaderSize(in.Reader, vcfChunkSize)
+
+		header, _, err := readVCFHeader(br)
+		if err != nil {
+			_ = in.Close()
+			return nil, err
+		}
+
+		in.skipped = offset - int64(len(header))
+		in.bgzfDelta = in.skipped
+
+		if _, err := io.CopyN(io.Discard, br, in.skipped); err != nil {
+			_ = in.Close()
+			return nil, fmt.Errorf("could not skip to checkpoint: %w", err)
+		}
+
+		in.Reader = io.MultiReader(bytes.NewReader(header), br)
+
+		return in, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &input{f: f}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not get file info: %w", err)
+	}
+
+	var header bytes.Buffer
+	if err := readBGZFHeader(&header, f, fi.Size()); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not read vcf header: %w", err)
+	}
+
+	progress.start(path)
+	progress.add(int(virtualOffset.Block()))
+
+	sr := io.NewSectionReader(f, virtualOffset.Block(), fi.Size()-virtualOffset.Block())
+
+	r := bgzf.NewReader(bufio.NewReaderSize(sr, bgzf.MaxBlockSize), runtime.NumCPU())
+	r.Progress = progress.add
+
+	in.dr = r
+	in.bgzfReader = r
+	in.bgzfBase = virtualOffset.Block()
+	in.skipped = offset - int64(header.Len())
+	in.bgzfDelta = int64(virtualOffset.Offset() - header.Len())
+
+	if _, err := io.CopyN(io.Discard, r, int64(virtualOffset.Offset())); err != nil {
+		_ = in.Close()
+		return nil, fmt.Errorf("could not skip to checkpoint: %w", err)
+	}
+
+	in.Reader = io.MultiReader(&header, r)
+
+	return in, nil
+}
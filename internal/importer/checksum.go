@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// Checksum is the expected digest of a file.
+type Checksum struct {
+	// Algorithm is either md5 or sha256.
+	Algorithm string
+	// Digest is hex encoded.
+	Digest string
+}
+
+func (c Checksum) String() string {
+	return c.Algorithm + ":" + c.Digest
+}
+
+// ParseChecksum parses a hex encoded md5 or sha256 digest, optionally
+// prefixed by its algorithm (eg. sha256:...).
+func ParseChecksum(s string) (*Checksum, error) {
+	algorithm, digest, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		digest = algorithm
+
+		switch len(digest) {
+		case 2 * 16:
+			algorithm = "md5"
+		case 2 * 32:
+			algorithm = "sha256"
+		default:
+			return nil, fmt.Errorf("unrecognized checksum %q", s)
+		}
+	}
+
+	algorithm = strings.ToLower(algorithm)
+	digest = strings.ToLower(digest)
+
+	var size int
+	switch algorithm {
+	case "md5":
+		size = 16
+	case "sha256":
+		size = 32
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != size {
+		return nil, fmt.Errorf("invalid %s checksum %q", algorithm, digest)
+	}
+
+	return &Checksum{Algorithm: algorithm, Digest: digest}, nil
+}
+
+// findChecksum reads the checksum published alongside a file, in a
+// <file>.sha256 or <file>.md5 sidecar (in the format written by sha256sum or
+// md5sum).
+func findChecksum(path string) (*Checksum, error) {
+	for _, algorithm := range []string{"sha256", "md5"} {
+		sidecar, err := os.ReadFile(path + "." + algorithm)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read checksum file: %w", err)
+		}
+
+		fields := strings.Fields(string(sidecar))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty checksum file: %s", path+"."+algorithm)
+		}
+
+		return ParseChecksum(algorithm + ":" + fields[0])
+	}
+
+	return nil, fmt.Errorf("no checksum file (%s.sha256 or %s.md5) found", path, path)
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/vcfgo"
+	"github.com/zymatik-com/importer/internal/store"
+	"github.com/zymatik-com/nucleo/names"
+)
+
+// ClinVar imports ClinVar clinical significance annotations into the genobase.
+func ClinVar(ctx context.Context, logger *slog.Logger, st *store.DB, clinVarPath string, batching BatchOptions, progress *Progress) error {
+	in, err := openInput(ctx, clinVarPath, progress)
+	if err != nil {
+		return fmt.Errorf("could not open ClinVar file: %w", err)
+	}
+	defer in.Close()
+
+	vcfReader, err := vcfgo.NewReader(in, false)
+	if err != nil {
+		return fmt.Errorf("could not create vcf reader: %w", err)
+	}
+
+	batch := newBatcher(logger, batching)
+
+	var records []store.ClinVarRecord
+	for {
+		variant := vcfReader.Read()
+		if variant == nil {
+			break
+		}
+
+		info := variant.Info()
+
+		// Only concerned with variants that have an RSID.
+		rs, ok := infoString(info, "RS")
+		if !ok {
+			continue
+		}
+
+		variationID, err := strconv.ParseInt(variant.Id(), 10, 64)
+		if err != nil {
+			logger.Warn("Could not parse variation ID", "id", variant.Id(), "error", err)
+
+			continue
+		}
+
+		// ClinVar only lists a single alternate allele per record, but some
+		// records (eg. no-call sites) have none.
+		var alternate string
+		if len(variant.Alt()) > 0 {
+			alternate = variant.Alt()[0]
+		}
+
+		clinicalSignificance, _ := infoString(info, "CLNSIG")
+		reviewStatus, _ := infoString(info, "CLNREVSTAT")
+		diseaseNames, _ := infoString(info, "CLNDN")
+		genes, _ := infoString(info, "GENEINFO")
+
+		for _, idStr := range strings.Split(rs, "|") {
+			id, err := strconv.ParseInt(strings.TrimPrefix(idStr, "rs"), 10, 64)
+			if err != nil {
+				logger.Warn("Could not parse variant ID", "id", idStr, "error", err)
+
+				continue
+			}
+
+			record := store.ClinVarRecord{
+				ID:                   id,
+				VariationID:          variationID,
+				Chromosome:           names.Chromosome(variant.Chromosome),
+				Position:             int64(variant.Pos),
+				Reference:            variant.Ref(),
+				Alternate:            alternate,
+				ClinicalSignificance: clinVarText(clinicalSignificance),
+				ReviewStatus:         clinVarText(reviewStatus),
+				DiseaseNames:         clinVarText(diseaseNames),
+				Genes:                genes,
+			}
+			records = append(records, record)
+
+			batch.add(1, approximateRowBytes(record.Chromosome, record.Reference, record.Alternate,
+				record.ClinicalSignificance, record.ReviewStatus, record.DiseaseNames, record.Genes))
+		}
+
+		if batch.full() {
+			if err := batch.store(func() error { return st.StoreClinVarRecords(ctx, records) }); err != nil {
+				return fmt.Errorf("could not store clinvar records: %w", err)
+			}
+
+			records = records[:0]
+		}
+	}
+
+	if len(records) > 0 {
+		if err := batch.store(func() error { return st.StoreClinVarRecords(ctx, records) }); err != nil {
+			return fmt.Errorf("could not store clinvar records: %w", err)
+		}
+	}
+
+	if err := vcfReader.Error(); err != nil {
+		return fmt.Errorf("vcf reader error: %w", err)
+	}
+
+	return nil
+}
+
+// ClinVar escapes spaces in INFO values as underscores.
+func clinVarText(s string) string {
+	return strings.ReplaceAll(s, "_", " ")
+}
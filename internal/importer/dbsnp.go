@@ -21,191 +21,277 @@ package importer
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/brentp/vcfgo"
-	"github.com/cheggaaa/pb/v3"
 	"github.com/zymatik-com/genobase"
 	"github.com/zymatik-com/genobase/types"
-	"github.com/zymatik-com/nucleo/compress"
+	"github.com/zymatik-com/importer/internal/store"
 )
 
-const (
-	batchSize = 1000
-)
-
-// For the GRCh38 assembly:
-var idToChromosome = map[string]string{
-	"NC_000001.11": "1",
-	"NC_000002.12": "2",
-	"NC_000003.12": "3",
-	"NC_000004.12": "4",
-	"NC_000005.10": "5",
-	"NC_000006.12": "6",
-	"NC_000007.14": "7",
-	"NC_000008.11": "8",
-	"NC_000009.12": "9",
-	"NC_000010.11": "10",
-	"NC_000011.10": "11",
-	"NC_000012.12": "12",
-	"NC_000013.11": "13",
-	"NC_000014.9":  "14",
-	"NC_000015.10": "15",
-	"NC_000016.10": "16",
-	"NC_000017.11": "17",
-	"NC_000018.10": "18",
-	"NC_000019.10": "19",
-	"NC_000020.11": "20",
-	"NC_000021.9":  "21",
-	"NC_000022.11": "22",
-	"NC_000023.11": "X",
-	"NC_000024.10": "Y",
-	"NC_012920.1":  "MT",
+// DBSNPOptions are the options for a dbSNP import.
+type DBSNPOptions struct {
+	// Reference is the assembly the dbSNP VCF is aligned to.
+	Reference types.Reference
+	// CommonOnly only imports common variants.
+	CommonOnly bool
+	// KnownOnly only imports variants we have allele frequencies for.
+	KnownOnly bool
+	// ReferenceFASTAPath is an optional reference sequence used to left-align
+	// indels (it must match the reference assembly).
+	ReferenceFASTAPath string
+	// Workers is the number of records to parse concurrently (defaults to
+	// the number of CPUs).
+	Workers int
+	// Regions, if set, restricts the import to variants within them.
+	Regions []Region
+	// Resume continues an interrupted import from its last checkpoint.
+	Resume bool
+	// Strict aborts the import on the first malformed record.
+	Strict bool
+	// MaxErrors is the number of malformed records to skip before aborting
+	// the import (unlimited if not positive).
+	MaxErrors int
+	// Batch controls how many variants are stored per transaction.
+	Batch BatchOptions
 }
 
 // DBSNP imports dbSNP data into the genobase.
-func DBSNP(ctx context.Context, logger *slog.Logger, db *genobase.DB, dbSNPPath string, commonOnly, knownOnly, showProgress bool) error {
-	f, err := os.Open(dbSNPPath)
-	if err != nil {
-		return fmt.Errorf("could not open dbSNP file: %w", err)
+func DBSNP(ctx context.Context, logger *slog.Logger, db *genobase.DB, st *store.DB, dbSNPPath string, opts DBSNPOptions, progress *Progress, stats *Stats) error {
+	reference := opts.Reference
+
+	asm, ok := assemblies[reference]
+	if !ok {
+		return fmt.Errorf("unsupported reference: %s", reference)
 	}
 
-	var knownAlleles map[int64]bool
-	if knownOnly {
-		logger.Info("Getting known alleles (this may take a while)")
+	norm, err := newNormalizer(opts.ReferenceFASTAPath)
+	if err != nil {
+		return err
+	}
+	defer norm.Close()
 
-		knownAlleles, err = db.KnownAlleles(ctx)
-		if err != nil {
-			return fmt.Errorf("could not get known alleles: %w", err)
-		}
+	// Variant positions are only meaningful relative to a single assembly.
+	variantsReference, ok, err := st.Metadata(ctx, store.MetadataVariantsReference)
+	if err != nil {
+		return fmt.Errorf("could not get variants reference: %w", err)
 	}
 
-	var dr io.ReadCloser
-	if showProgress {
-		fi, err := f.Stat()
-		if err != nil {
-			return fmt.Errorf("could not get file info: %w", err)
-		}
+	if ok && variantsReference != string(reference) {
+		return fmt.Errorf("database contains %s variants, refusing to import %s variants", variantsReference, reference)
+	}
 
-		bar := pb.Full.Start64(fi.Size())
-		bar.Set(pb.Bytes, true)
-		defer bar.Finish()
+	if err := st.SetMetadata(ctx, store.MetadataVariantsReference, string(reference)); err != nil {
+		return fmt.Errorf("could not set variants reference: %w", err)
+	}
 
-		dr, err = compress.Decompress(bar.NewProxyReader(f))
-		if err != nil {
-			return fmt.Errorf("could not decompress dbSNP file: %w", err)
+	// Checkpoints are positions in the whole file.
+	var in *input
+	var checkpoints *checkpointer
+	if len(opts.Regions) > 0 {
+		if opts.Resume {
+			return fmt.Errorf("imports restricted to regions can't be resumed")
 		}
+
+		in, err = openVCF(ctx, logger, dbSNPPath, opts.Regions, asm.contigName, progress)
 	} else {
-		dr, err = compress.Decompress(f)
+		in, checkpoints, err = openCheckpointed(ctx, logger, st, variantsImport, dbSNPPath, opts.Resume, progress)
+	}
+	if err != nil {
+		return fmt.Errorf("could not open dbSNP file: %w", err)
+	}
+
+	// Already imported.
+	if in == nil {
+		return nil
+	}
+	defer in.Close()
+
+	var knownAlleles *knownAlleleSet
+	if opts.KnownOnly {
+		knownAlleles, err = loadKnownAlleles(ctx, logger, st)
 		if err != nil {
-			return fmt.Errorf("could not decompress dbSNP file: %w", err)
+			return err
 		}
 	}
-	defer dr.Close()
 
-	vcfReader, err := vcfgo.NewReader(dr, false)
+	records, err := newVCFPipeline[types.Variant](in)
 	if err != nil {
-		return fmt.Errorf("could not create vcf reader: %w", err)
+		return err
 	}
 
-	variants := make([]types.Variant, 0, batchSize)
-	for {
-		variant := vcfReader.Read()
-		if variant == nil {
-			break
-		}
+	var unknownContigsMu sync.Mutex
+	unknownContigs := make(map[string]bool)
 
-		variantClass, err := variant.Info().Get("VC")
-		if err != nil {
-			logger.Warn("Could not get variant class", "error", err)
+	budget := newErrorBudget(logger, dbSNPPath, opts.Strict, opts.MaxErrors, stats)
 
-			continue
+	records.start(ctx, opts.Workers, budget, func(variant *vcfgo.Variant) (types.Variant, bool, error) {
+		variantClass, ok := infoString(variant.Info(), "VC")
+		if !ok {
+			return types.Variant{}, false, fmt.Errorf("missing variant class (VC)")
 		}
 
 		// Do not store multi-nucleotide variants.
-		if variantClass.(string) == "MNV" {
-			continue
+		if variantClass == "MNV" {
+			stats.skip(variant, skipMultiNucleotide)
+
+			return types.Variant{}, false, nil
 		}
 
 		// Only store common variants.
-		if commonOnly {
-			common, err := variant.Info().Get("COMMON")
+		if opts.CommonOnly {
+			common, err := infoFlag(variant.Info(), "COMMON")
 			if err != nil {
-				logger.Warn("Could not get variant commonness", "error", err)
-
-				continue
+				return types.Variant{}, false, err
 			}
-			if !common.(bool) {
-				continue
+
+			if !common {
+				stats.skip(variant, skipNotCommon)
+
+				return types.Variant{}, false, nil
 			}
 		}
 
 		id, err := strconv.ParseInt(strings.TrimPrefix(variant.Id(), "rs"), 10, 64)
 		if err != nil {
-			logger.Warn("Could not parse variant ID", "id", variant.Id(), "error", err)
-
-			continue
+			return types.Variant{}, false, &fieldError{field: "ID", err: err}
 		}
 
-		if knownOnly {
-			if _, ok := knownAlleles[id]; !ok {
-				continue
+		if opts.KnownOnly {
+			if !knownAlleles.contains(id) {
+				stats.skip(variant, skipNotKnown)
+
+				return types.Variant{}, false, nil
 			}
 		}
 
-		chromosome, ok := idToChromosome[variant.Chromosome]
+		chromosome, ok := asm.chromosomes[variant.Chromosome]
 		if !ok {
-			continue
+			stats.skip(variant, skipUnknownContig)
+
+			unknownContigsMu.Lock()
+			defer unknownContigsMu.Unlock()
+
+			// Primary assembly accessions we don't recognize most likely mean the
+			// wrong reference was selected (as opposed to alt/patch contigs).
+			if !unknownContigs[variant.Chromosome] {
+				unknownContigs[variant.Chromosome] = true
+
+				if strings.HasPrefix(variant.Chromosome, "NC_") {
+					logger.Warn("Skipping variants on unknown contig", "contig", variant.Chromosome, "reference", reference)
+				} else {
+					logger.Debug("Skipping variants on unknown contig", "contig", variant.Chromosome, "reference", reference)
+				}
+			}
+
+			return types.Variant{}, false, nil
 		}
 
-		parRegion := (chromosome == "X" || chromosome == "Y") && variant.Pos >= 10001 && variant.Pos <= 2781479
+		position := variant.Pos
+
+		// Given a reference sequence, store the left-aligned position.
+		if opts.ReferenceFASTAPath != "" {
+			normalized, err := norm.normalize(chromosome, variant.Pos, variant.Ref(), variant.Alt())
+			if err != nil {
+				logger.Debug("Could not normalize variant", "id", variant.Id(), "error", err)
+
+				reason := skipNormalize
+				if errors.Is(err, errReferenceMismatch) {
+					reason = skipReferenceMismatch
+				}
+
+				stats.skip(variant, reason)
 
-		par2Region := (chromosome == "X" && variant.Pos >= 155701383 && variant.Pos <= 156030895) ||
-			(chromosome == "Y" && variant.Pos >= 56887903 && variant.Pos <= 57217415)
+				return types.Variant{}, false, nil
+			}
 
-		// drop pseudo-autosomal copies from Y chromosome.
-		if (parRegion || par2Region) && chromosome == "Y" {
-			continue
+			for i, allele := range normalized {
+				if i == 0 || allele.pos < position {
+					position = allele.pos
+				}
+			}
 		}
 
 		// Remap pseudo-autosomal regions to a special PAR chromosome
 		// (positions will be relative to the X chromosomes).
-		if parRegion {
-			chromosome = "PAR"
-		} else if par2Region {
-			chromosome = "PAR2"
+		if par := asm.pseudoAutosomalRegion(chromosome, position); par != "" {
+			// drop pseudo-autosomal copies from Y chromosome.
+			if chromosome == "Y" {
+				stats.skip(variant, skipPseudoAutosomal)
+
+				return types.Variant{}, false, nil
+			}
+
+			chromosome = par
 		}
 
-		variants = append(variants, types.Variant{
+		return types.Variant{
 			ID:         id,
 			Chromosome: chromosome,
-			Position:   int64(variant.Pos),
-			Class:      types.VariantClass(variantClass.(string)),
-		})
+			Position:   int64(position),
+			Class:      types.VariantClass(variantClass),
+		}, true, nil
+	})
+	defer records.Close()
+
+	batch := newBatcher(logger, opts.Batch)
 
-		if len(variants) >= batchSize {
-			if err := db.StoreVariants(ctx, variants); err != nil {
+	var stored int64
+	var variants []types.Variant
+	for {
+		variant, ok, err := records.Next()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		variants = append(variants, variant)
+
+		batch.add(1, approximateRowBytes(variant.Chromosome, string(variant.Class)))
+
+		if batch.full() {
+			if err := batch.store(func() error { return db.StoreVariants(ctx, variants) }); err != nil {
 				return fmt.Errorf("could not store variants: %w", err)
 			}
+			stored += int64(len(variants))
+			stats.stored(len(variants), unitVariants)
+
+			if err := checkpoints.save(ctx, records.Offset(), variantRecord(variants[len(variants)-1])); err != nil {
+				return err
+			}
 
 			variants = variants[:0]
 		}
 	}
 
 	if len(variants) > 0 {
-		if err := db.StoreVariants(ctx, variants); err != nil {
+		if err := batch.store(func() error { return db.StoreVariants(ctx, variants) }); err != nil {
 			return fmt.Errorf("could not store variants: %w", err)
 		}
+		stored += int64(len(variants))
+		stats.stored(len(variants), unitVariants)
 	}
 
-	if err := vcfReader.Error(); err != nil {
-		return fmt.Errorf("vcf reader error: %w", err)
+	if err := checkpoints.complete(ctx); err != nil {
+		return err
+	}
+
+	if stored == 0 && len(unknownContigs) > 0 {
+		logger.Warn("No variants were imported, does the dbSNP file match the reference?", "reference", reference)
 	}
 
 	return nil
 }
+
+// variantRecord identifies a variant in a checkpoint.
+func variantRecord(variant types.Variant) string {
+	return fmt.Sprintf("rs%d (%s:%d)", variant.ID, variant.Chromosome, variant.Position)
+}
@@ -0,0 +1,315 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// ExpandPaths expands any glob patterns in the given paths (matches are
+// sorted by name). Every pattern must match at least one file.
+func ExpandPaths(patterns []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+
+		for _, path := range matches {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// SortByChromosome orders VCF files (eg. split per chromosome) by the
+// chromosome of their first record, in karyotypic order. Files without any
+// records are sorted last.
+func SortByChromosome(paths []string) ([]string, error) {
+	chromosomes, err := firstChromosomes(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := slices.Clone(paths)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return compareChromosomes(chromosomes[a], chromosomes[b])
+	})
+
+	return sorted, nil
+}
+
+// compareChromosomes compares two chromosomes using chromosomeOrder, with
+// missing chromosomes last.
+func compareChromosomes(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	default:
+		return compareLoci(a, 0, b, 0)
+	}
+}
+
+// firstChromosomes returns the chromosome of the first record of each VCF.
+func firstChromosomes(paths []string) (map[string]string, error) {
+	chromosomes := make(map[string]string, len(paths))
+	for _, path := range paths {
+		chromosome, err := firstChromosome(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path, err)
+		}
+
+		chromosomes[path] = chromosome
+	}
+
+	return chromosomes, nil
+}
+
+func firstChromosome(path string) (string, error) {
+	in, err := openInput(context.Background(), path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+
+		if line != "" && line[0] != '#' {
+			chromosome, _, _ := strings.Cut(line, "\t")
+			return strings.TrimSpace(chromosome), nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			return "", nil
+		}
+	}
+}
+
+// FilesOptions are the options for importing a set of files.
+type FilesOptions struct {
+	// Import is the kind of import (eg. variants), recorded in the provenance
+	// of each file.
+	Import string
+	// Options are the options of the import, also recorded in the provenance
+	// of each file.
+	Options map[string]string
+	// ContinueOnError imports the remaining files when one fails.
+	ContinueOnError bool
+	// Progress, if set, displays the combined progress of the imports.
+	Progress *Progress
+	// Verify checks each file against the checksum published alongside it
+	// (in a <file>.sha256 or <file>.md5 sidecar).
+	Verify bool
+	// Checksum, if set, is the expected checksum of the (single) file.
+	Checksum *Checksum
+	// Rejects, if set, receives the records skipped by the imports.
+	Rejects *Rejects
+}
+
+// ImportFiles calls importFiles for each group of files (usually a single
+// file) in turn, recording the provenance of each file and logging a summary
+// of each import once all are done. Unless continueOnError is set, the first
+// failure stops the remaining imports. If the context is cancelled (eg. on
+// SIGINT) the current import is stopped, and no more are started. When
+// verifying checksums, each file is checked before it is imported, and files
+// which don't match aren't imported at all. Imports that count their records (in stats) have their
+// statistics logged and recorded with their provenance.
+func ImportFiles(ctx context.Context, logger *slog.Logger, st *store.DB, files [][]string, opts FilesOptions, importFiles func(ctx context.Context, paths []string, stats *Stats) error) error {
+	type result struct {
+		status   string
+		duration time.Duration
+	}
+
+	var checksums map[string]*Checksum
+	if opts.Checksum != nil {
+		if len(files) != 1 || len(files[0]) != 1 {
+			return fmt.Errorf("a checksum can only be given when importing a single file")
+		}
+
+		checksums = map[string]*Checksum{files[0][0]: opts.Checksum}
+	} else if opts.Verify {
+		// Find all the checksums up front, rather than failing part way through.
+		checksums = make(map[string]*Checksum)
+		for _, paths := range files {
+			for _, path := range paths {
+				checksum, err := findChecksum(path)
+				if err != nil {
+					return fmt.Errorf("could not verify %s: %w", path, err)
+				}
+
+				checksums[path] = checksum
+			}
+		}
+	}
+
+	results := make([]result, len(files))
+	for i := range results {
+		results[i].status = "skipped"
+	}
+
+	stopWatching := context.AfterFunc(ctx, func() {
+		logger.Warn("Interrupted, stopping the import (interrupt again to exit immediately)")
+	})
+	defer stopWatching()
+
+	// Only worth summarizing when there is more than one import, or when we
+	// were interrupted.
+	defer func() {
+		if len(files) < 2 && ctx.Err() == nil {
+			return
+		}
+
+		for i, paths := range files {
+			logger.Info("Import summary", "paths", paths, "status", results[i].status, "duration", results[i].duration.Round(time.Second))
+		}
+	}()
+
+	var failed int
+	for i, paths := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var provenance []*fileProvenance
+		for _, path := range paths {
+			p, err := startProvenance(ctx, opts.Import, opts.Options, path, checksums[path])
+			if err != nil {
+				return err
+			}
+
+			provenance = append(provenance, p)
+		}
+
+		stats := newStats(opts.Rejects)
+
+		started := time.Now()
+
+		// Verify the files before importing any of their records.
+		var err error
+		for _, p := range provenance {
+			if p.expected != nil {
+				logger.Info("Verifying checksum", "path", p.path)
+			}
+
+			if err = p.verify(ctx); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			err = importFiles(withProvenance(ctx, provenance), paths, stats)
+		}
+
+		results[i].duration = time.Since(started)
+
+		for _, p := range provenance {
+			if hashErr := p.wait(ctx); hashErr != nil && err == nil {
+				err = hashErr
+			}
+		}
+
+		mismatch := errors.Is(err, errChecksumMismatch)
+
+		switch {
+		case mismatch:
+			results[i].status = "checksum mismatch"
+		case err != nil && ctx.Err() != nil:
+			results[i].status = "interrupted"
+		case err != nil:
+			results[i].status = "failed"
+		default:
+			results[i].status = "imported"
+		}
+
+		summary := stats.summary()
+		if summary != nil {
+			summary.log(logger, paths)
+		}
+
+		for _, p := range provenance {
+			if err := p.finish(ctx, st, results[i].status, summary); err != nil {
+				return err
+			}
+		}
+
+		if mismatch {
+			// Resuming would only pick up where an earlier import of the bad
+			// file left off (even if we were interrupted).
+			for _, path := range paths {
+				if err := deleteCheckpoints(context.WithoutCancel(ctx), st, path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("interrupted importing %s: %w", strings.Join(paths, " and "), err)
+		}
+
+		opts.Progress.done(paths...)
+
+		if err != nil {
+			err = fmt.Errorf("could not import %s: %w", strings.Join(paths, " and "), err)
+			if !opts.ContinueOnError {
+				return err
+			}
+
+			logger.Error("Import failed, continuing with the remaining files", "error", err)
+
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d imports failed", failed, len(files))
+	}
+
+	return nil
+}
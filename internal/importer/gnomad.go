@@ -20,19 +20,22 @@
 package importer
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/brentp/irelate/interfaces"
 	"github.com/brentp/vcfgo"
-	"github.com/cheggaaa/pb/v3"
 	"github.com/zymatik-com/genobase"
 	"github.com/zymatik-com/genobase/types"
-	"github.com/zymatik-com/nucleo/compress"
+	"github.com/zymatik-com/importer/internal/store"
 	"github.com/zymatik-com/nucleo/names"
 )
 
@@ -66,246 +69,1220 @@ var mtDNAAncestryGroups = []types.AncestryGroup{
 	types.AncestryGroupMiddleEastern,
 }
 
+// GnoMADOptions are the options for a gnoMAD import.
+type GnoMADOptions struct {
+	// MinimumFrequency is the minimum (overall) allele frequency to include.
+	MinimumFrequency float64
+	// ReferenceFASTAPath is an optional reference sequence used to left-align indels.
+	ReferenceFASTAPath string
+	// AncestryMappingPath is an optional file mapping INFO fields to ancestry
+	// groups (overriding the detected gnoMAD schema).
+	AncestryMappingPath string
+	// Source is the gnoMAD dataset (exome or genome) being imported, if not
+	// set it is guessed from the file name.
+	Source store.AlleleSource
+	// Joint combines the imported frequencies with those previously imported
+	// from the other gnoMAD dataset (using the allele counts of each), which
+	// must have been imported with a minimum frequency of zero.
+	Joint bool
+	// SexSpecific also imports XX/XY allele frequencies for variants on the
+	// sex chromosomes.
+	SexSpecific bool
+	// Workers is the number of records to parse concurrently (defaults to
+	// the number of CPUs).
+	Workers int
+	// Regions, if set, restricts the import to variants within them.
+	Regions []Region
+	// Strict aborts the import on the first malformed record.
+	Strict bool
+	// MaxErrors is the number of malformed records to skip before aborting
+	// the import (unlimited if not positive).
+	MaxErrors int
+	// Batch controls how many alleles are stored per transaction.
+	Batch BatchOptions
+}
+
 // GnoMAD imports gnoMAD allele frequency data into the genobase.
-func GnoMAD(ctx context.Context, logger *slog.Logger, db *genobase.DB, gnoMADPath string, minumumFrequency float64, showProgress bool) error {
-	f, err := os.Open(gnoMADPath)
+func GnoMAD(ctx context.Context, logger *slog.Logger, db *genobase.DB, st *store.DB, gnoMADPath string, opts GnoMADOptions, progress *Progress, stats *Stats) error {
+	source := opts.Source
+	if source == "" {
+		source = gnoMADSource(gnoMADPath)
+	}
+
+	if err := checkMinimumFrequency(ctx, st, opts, source); err != nil {
+		return err
+	}
+
+	norm, err := newNormalizer(opts.ReferenceFASTAPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer norm.Close()
 
-	var dr io.ReadCloser
-	if showProgress {
-		fi, err := f.Stat()
+	r, err := openGnoMAD(ctx, logger, gnoMADPath, source, norm, opts, progress, stats)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w := &alleleWriter{db: db, st: st, opts: opts, stats: stats, batch: newBatcher(logger, opts.Batch)}
+	for {
+		site, err := r.next()
 		if err != nil {
-			return fmt.Errorf("could not get file info: %w", err)
+			return err
 		}
 
-		bar := pb.Full.Start64(fi.Size())
-		bar.Set(pb.Bytes, true)
-		defer bar.Finish()
+		if site == nil {
+			break
+		}
 
-		dr, err = compress.Decompress(bar.NewProxyReader(f))
-		if err != nil {
-			return fmt.Errorf("could not decompress gnoMAD file: %w", err)
+		if err := w.write(ctx, site.alleles); err != nil {
+			return err
 		}
-	} else {
-		dr, err = compress.Decompress(f)
-		if err != nil {
-			return fmt.Errorf("could not decompress gnoMAD file: %w", err)
+	}
+
+	return w.flush(ctx)
+}
+
+// GnoMADJoint imports the gnoMAD exome and genome datasets together, storing
+// joint allele frequencies (computed from the allele counts of each) for the
+// alleles present in both. Both VCFs must be sorted in karyotypic order.
+func GnoMADJoint(ctx context.Context, logger *slog.Logger, db *genobase.DB, st *store.DB, exomesPath, genomesPath string, opts GnoMADOptions, progress *Progress, stats *Stats) error {
+	// Alleles in only one of the datasets are stored as estimates of it.
+	for _, source := range []store.AlleleSource{store.AlleleSourceExome, store.AlleleSourceGenome} {
+		if err := checkMinimumFrequency(ctx, st, opts, source); err != nil {
+			return err
 		}
 	}
-	defer dr.Close()
 
-	vcfReader, err := vcfgo.NewReader(dr, false)
+	norm, err := newNormalizer(opts.ReferenceFASTAPath)
 	if err != nil {
-		return fmt.Errorf("could not create vcf reader: %w", err)
+		return err
 	}
+	defer norm.Close()
 
-	var alleles []types.Allele
-	for {
-		variant := vcfReader.Read()
-		if variant == nil {
-			break
+	exomes, err := openGnoMAD(ctx, logger, exomesPath, store.AlleleSourceExome, norm, opts, progress, stats)
+	if err != nil {
+		return err
+	}
+	defer exomes.Close()
+	exomes.requireSorted = true
+
+	genomes, err := openGnoMAD(ctx, logger, genomesPath, store.AlleleSourceGenome, norm, opts, progress, stats)
+	if err != nil {
+		return err
+	}
+	defer genomes.Close()
+	genomes.requireSorted = true
+
+	exomeSite, err := exomes.next()
+	if err != nil {
+		return err
+	}
+
+	genomeSite, err := genomes.next()
+	if err != nil {
+		return err
+	}
+
+	// Merge join the two datasets by position.
+	w := &alleleWriter{db: db, st: st, opts: opts, stats: stats, batch: newBatcher(logger, opts.Batch)}
+	for exomeSite != nil || genomeSite != nil {
+		var alleles []gnoMADAllele
+
+		c := compareSites(exomeSite, genomeSite)
+		switch {
+		case c < 0:
+			alleles = exomeSite.alleles
+		case c > 0:
+			alleles = genomeSite.alleles
+		default:
+			alleles = joinAlleles(exomeSite.alleles, genomeSite.alleles)
 		}
 
-		// Only concerned with high quality variants.
-		if variant.Filter != "PASS" {
-			continue
+		if err := w.write(ctx, alleles); err != nil {
+			return err
 		}
 
-		var ids []int64
-		if strings.HasPrefix(variant.Id(), "rs") {
-			for _, idStr := range strings.Split(variant.Id(), ";") {
-				if !strings.HasPrefix(idStr, "rs") {
-					continue
-				}
+		if c <= 0 {
+			if exomeSite, err = exomes.next(); err != nil {
+				return err
+			}
+		}
 
-				id, err := strconv.ParseInt(strings.TrimPrefix(idStr, "rs"), 10, 64)
-				if err != nil {
-					logger.Warn("Could not parse variant ID", "id", variant.Id(), "error", err)
+		if c >= 0 {
+			if genomeSite, err = genomes.next(); err != nil {
+				return err
+			}
+		}
+	}
 
-					continue
-				}
+	return w.flush(ctx)
+}
+
+// checkMinimumFrequency records the minimum frequency a gnoMAD dataset is
+// imported with. Joining with the stored estimates of the other dataset is
+// refused unless it was imported with a minimum frequency of zero, as the
+// estimates of its rarer alleles would be missing (inflating the joint
+// frequencies).
+func checkMinimumFrequency(ctx context.Context, st *store.DB, opts GnoMADOptions, source store.AlleleSource) error {
+	if source == store.AlleleSourceJoint {
+		if opts.Joint {
+			return fmt.Errorf("can't join %s estimates with another dataset", source)
+		}
+
+		return nil
+	}
+
+	if opts.Joint {
+		other, _ := otherSource(source)
 
-				ids = append(ids, id)
+		value, ok, err := st.Metadata(ctx, store.MetadataMinimumFrequency(other))
+		if err != nil {
+			return fmt.Errorf("could not get minimum frequency: %w", err)
+		}
+
+		if ok {
+			minimumFrequency, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid minimum frequency %q: %w", value, err)
+			}
+
+			if minimumFrequency > 0 {
+				return fmt.Errorf("gnoMAD %ss were imported with a minimum frequency of %g, joint frequencies need them all (import them again with a minimum frequency of 0)", other, minimumFrequency)
 			}
 		}
+	}
+
+	// The estimates of this dataset are stored (for later joins) even when
+	// joining, so its minimum frequency matters either way.
+	if err := st.SetMetadata(ctx, store.MetadataMinimumFrequency(source), strconv.FormatFloat(opts.MinimumFrequency, 'g', -1, 64)); err != nil {
+		return fmt.Errorf("could not set minimum frequency: %w", err)
+	}
+
+	return nil
+}
+
+// otherSource returns the gnoMAD dataset an exome or genome estimate can be
+// joined with.
+func otherSource(source store.AlleleSource) (store.AlleleSource, bool) {
+	switch source {
+	case store.AlleleSourceExome:
+		return store.AlleleSourceGenome, true
+	case store.AlleleSourceGenome:
+		return store.AlleleSourceExome, true
+	default:
+		return "", false
+	}
+}
+
+// gnoMADSource guesses the gnoMAD dataset of a VCF, from its schema (gnoMAD
+// v4 joint files combine both datasets) or otherwise its file name (eg.
+// gnomad.exomes.v4.1.sites.chr1.vcf.bgz).
+func gnoMADSource(path string) store.AlleleSource {
+	// Unreadable files will fail to import, so fall back to the file name.
+	if schema, err := readGnoMADHeaderSchema(path); err == nil && schema.version == gnoMADVersion4Joint {
+		return store.AlleleSourceJoint
+	}
+
+	if strings.Contains(strings.ToLower(filepath.Base(path)), "exome") {
+		return store.AlleleSourceExome
+	}
+
+	return store.AlleleSourceGenome
+}
+
+// readGnoMADHeaderSchema detects the gnoMAD schema of a VCF from its header.
+func readGnoMADHeaderSchema(path string) (*gnoMADSchema, error) {
+	in, err := openInput(context.Background(), path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	header, _, err := readVCFHeader(bufio.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+
+	vcfReader, err := vcfgo.NewReader(bytes.NewReader(header), true)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vcf reader: %w", err)
+	}
+
+	return detectGnoMADSchema(vcfReader.Header)
+}
 
-		// Only concerned with variants that have an RSID.
-		if len(ids) == 0 {
+// GnoMADFiles groups gnoMAD files for import, in chromosome order. When both
+// exome and genome files are given (and the source isn't set) they are paired
+// by chromosome, as an exomes and genomes file to be imported together with
+// GnoMADJoint. Files without a counterpart, and gnoMAD v4 joint files, are
+// imported on their own.
+func GnoMADFiles(logger *slog.Logger, paths []string, source store.AlleleSource) ([][]string, error) {
+	chromosomes, err := firstChromosomes(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var files [][]string
+	var exomes, genomes []string
+	for _, path := range paths {
+		if source != "" {
+			genomes = append(genomes, path)
 			continue
 		}
 
-		info := variant.Info()
+		switch gnoMADSource(path) {
+		case store.AlleleSourceExome:
+			exomes = append(exomes, path)
+		case store.AlleleSourceJoint:
+			// Already joint, so never paired.
+			files = append(files, []string{path})
+		default:
+			genomes = append(genomes, path)
+		}
+	}
 
-		if names.Chromosome(variant.Chromosome) != "MT" {
-			overallFrequency, err := info.Get("AF")
-			if err != nil {
-				logger.Warn("Could not get variant frequency", "error", err)
-				continue
+	for _, exomesPath := range exomes {
+		i := slices.IndexFunc(genomes, func(genomesPath string) bool {
+			return compareChromosomes(chromosomes[exomesPath], chromosomes[genomesPath]) == 0
+		})
+		if i < 0 {
+			if len(genomes) > 0 {
+				logger.Warn("No gnoMAD genomes file for the same chromosome, importing exomes alone", "path", exomesPath)
 			}
 
-			// Not concerned with very rare variants.
-			if float64(overallFrequency.([]float32)[0]) < minumumFrequency {
+			files = append(files, []string{exomesPath})
+			continue
+		}
+
+		files = append(files, []string{exomesPath, genomes[i]})
+		genomes = slices.Delete(genomes, i, i+1)
+	}
+
+	for _, genomesPath := range genomes {
+		if len(exomes) > 0 {
+			logger.Warn("No gnoMAD exomes file for the same chromosome, importing genomes alone", "path", genomesPath)
+		}
+
+		files = append(files, []string{genomesPath})
+	}
+
+	slices.SortStableFunc(files, func(a, b []string) int {
+		return compareChromosomes(chromosomes[a[0]], chromosomes[b[0]])
+	})
+
+	return files, nil
+}
+
+// gnoMADAllele is a (normalized) gnoMAD allele and its frequency in each
+// ancestry group.
+type gnoMADAllele struct {
+	// The record the allele was read from (for reporting).
+	chromosome string
+	pos        uint64
+	ids        []int64
+	reference  string
+	alternate  string
+	// The first estimate is always the overall one.
+	estimates []ancestryEstimate
+	// Sex-specific estimates (if requested).
+	karyotypeEstimates []karyotypeEstimate
+	// The estimates of each dataset that joint estimates (above) were
+	// computed from, which are stored too so the joint estimates can be
+	// computed again when either dataset is re-imported.
+	datasetEstimates          []ancestryEstimate
+	datasetKaryotypeEstimates []karyotypeEstimate
+}
+
+// rows returns the (maximum) number of rows an allele will be stored as, and
+// their approximate size.
+func (a gnoMADAllele) rows() (int, int) {
+	rows := (len(a.estimates) + len(a.karyotypeEstimates) + len(a.datasetEstimates) + len(a.datasetKaryotypeEstimates)) * len(a.ids)
+
+	// Estimates are stored both in the genobase, and with their provenance.
+	return rows, 2 * rows * approximateRowBytes(a.reference, a.alternate)
+}
+
+// gnoMADSite is all the alleles of a gnoMAD VCF at a given position.
+type gnoMADSite struct {
+	chromosome string
+	pos        uint64
+	alleles    []gnoMADAllele
+}
+
+// compareSites compares the positions of two sites, a nil site (end of file)
+// sorts after everything else.
+func compareSites(a, b *gnoMADSite) int {
+	switch {
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	default:
+		return compareLoci(a.chromosome, a.pos, b.chromosome, b.pos)
+	}
+}
+
+// gnoMADReader reads the alleles of a gnoMAD VCF, a site at a time.
+type gnoMADReader struct {
+	logger  *slog.Logger
+	in      *input
+	records *vcfPipeline[*gnoMADSite]
+	schema  *gnoMADSchema
+	norm    *normalizer
+	source  store.AlleleSource
+	stats   *Stats
+	// Read sex-specific allele frequencies (for the sex chromosomes).
+	sexSpecific bool
+	// Fail if the VCF is not sorted (required for merging files).
+	requireSorted bool
+	// The first record of the next site.
+	pending *gnoMADSite
+	last    *gnoMADSite
+}
+
+func openGnoMAD(ctx context.Context, logger *slog.Logger, path string, source store.AlleleSource, norm *normalizer, opts GnoMADOptions, progress *Progress, stats *Stats) (*gnoMADReader, error) {
+	in, err := openVCF(ctx, logger, path, opts.Regions, names.Chromosome, progress)
+	if err != nil {
+		return nil, fmt.Errorf("could not open gnoMAD file: %w", err)
+	}
+
+	records, err := newVCFPipeline[*gnoMADSite](in)
+	if err != nil {
+		_ = in.Close()
+		return nil, err
+	}
+
+	var schema *gnoMADSchema
+	if opts.AncestryMappingPath != "" {
+		schema, err = readGnoMADSchema(opts.AncestryMappingPath)
+	} else {
+		schema, err = detectGnoMADSchema(records.Header)
+	}
+	if err == nil {
+		err = schema.validate(records.Header)
+	}
+	if err != nil {
+		_ = in.Close()
+		return nil, err
+	}
+
+	logger.Info("Using gnoMAD schema", "path", path, "version", schema.version, "source", source)
+
+	for _, ancestry := range schema.absent {
+		logger.Warn("Ancestry group not present in this gnoMAD release", "version", schema.version, "ancestry", ancestry)
+	}
+
+	if opts.SexSpecific {
+		schema.detectKaryotypeKeys(records.Header)
+
+		if len(schema.karyotypeKeys) == 0 {
+			logger.Warn("No sex-specific allele frequencies in gnoMAD file", "path", path)
+		}
+	}
+
+	r := &gnoMADReader{
+		logger:      logger,
+		in:          in,
+		records:     records,
+		schema:      schema,
+		norm:        norm,
+		source:      source,
+		stats:       stats,
+		sexSpecific: opts.SexSpecific,
+	}
+
+	budget := newErrorBudget(logger, path, opts.Strict, opts.MaxErrors, stats)
+
+	records.start(ctx, opts.Workers, budget, func(variant *vcfgo.Variant) (*gnoMADSite, bool, error) {
+		alleles, err := r.alleles(variant)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return &gnoMADSite{
+			chromosome: variant.Chromosome,
+			pos:        variant.Pos,
+			alleles:    alleles,
+		}, len(alleles) > 0, nil
+	})
+
+	return r, nil
+}
+
+func (r *gnoMADReader) Close() error {
+	r.records.Close()
+
+	return r.in.Close()
+}
+
+// next returns the alleles at the next site (that has any alleles we are
+// interested in), or nil once the VCF has been read.
+func (r *gnoMADReader) next() (*gnoMADSite, error) {
+	site := r.pending
+	r.pending = nil
+	if site == nil {
+		var ok bool
+		var err error
+		if site, ok, err = r.records.Next(); err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	if r.requireSorted && r.last != nil && compareSites(r.last, site) > 0 {
+		return nil, fmt.Errorf("gnoMAD file is not sorted (%s:%d follows %s:%d)",
+			site.chromosome, site.pos, r.last.chromosome, r.last.pos)
+	}
+	r.last = site
+
+	// Multi-allelic sites may be split across several records.
+	for {
+		record, ok, err := r.records.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			break
+		}
+
+		if record.chromosome != site.chromosome || record.pos != site.pos {
+			r.pending = record
+			break
+		}
+
+		site.alleles = append(site.alleles, record.alleles...)
+	}
+
+	return site, nil
+}
+
+// alleles returns the (normalized) alleles of a gnoMAD record that we are
+// interested in, or an error if the record is malformed.
+func (r *gnoMADReader) alleles(variant *vcfgo.Variant) ([]gnoMADAllele, error) {
+	// Only concerned with high quality variants.
+	if variant.Filter != "PASS" {
+		r.stats.skip(variant, skipFiltered)
+
+		return nil, nil
+	}
+
+	var ids []int64
+	if strings.HasPrefix(variant.Id(), "rs") {
+		for _, idStr := range strings.Split(variant.Id(), ";") {
+			if !strings.HasPrefix(idStr, "rs") {
 				continue
 			}
 
-			variantType, err := info.Get("allele_type")
+			id, err := strconv.ParseInt(strings.TrimPrefix(idStr, "rs"), 10, 64)
 			if err != nil {
-				logger.Warn("Could not get variant type", "error", err)
-				continue
+				return nil, &fieldError{field: "ID", err: err}
 			}
 
-			// Only concerned with SNVs, and INDELs.
-			if strings.ToUpper(variantType.(string)) != "SNV" &&
-				strings.ToUpper(variantType.(string)) != "INS" &&
-				strings.ToUpper(variantType.(string)) != "DEL" {
-				continue
-			}
+			ids = append(ids, id)
+		}
+	}
 
-			if len(variant.Alt()) != 1 {
-				continue
-			}
+	// Only concerned with variants that have an RSID.
+	if len(ids) == 0 {
+		r.stats.skip(variant, skipNoRSID)
 
-			for _, ancestry := range ancestryGroups {
-				var frequency float64
-				if ancestry == types.AncestryGroupAll {
-					frequency = float64(overallFrequency.([]float32)[0])
-				} else {
-					key := fmt.Sprintf("AF_%s", strings.ToLower(string(ancestry)))
-
-					populationFrequency, err := info.Get(key)
-					if err != nil {
-						continue
-					} else {
-						frequency = float64(populationFrequency.([]float32)[0])
-					}
-				}
+		return nil, nil
+	}
 
-				// Conserve space by rounding ancestry group frequencies down to zero where appropriate.
-				if frequency > minumumFrequency/100.0 {
-					for _, id := range ids {
-						alleles = append(alleles, types.Allele{
-							ID:        id,
-							Reference: variant.Ref(),
-							Alternate: variant.Alt()[0],
-							Ancestry:  ancestry,
-							Frequency: frequency,
-						})
-					}
-				}
-			}
+	// Decompose multi-allelic records into (normalized) biallelic alleles.
+	normalized, err := r.norm.normalize(variant.Chromosome, variant.Pos, variant.Ref(), variant.Alt())
+	if err != nil {
+		r.logger.Debug("Could not normalize variant", "id", variant.Id(), "error", err)
+
+		reason := skipNormalize
+		if errors.Is(err, errReferenceMismatch) {
+			reason = skipReferenceMismatch
+		}
+
+		r.stats.skip(variant, reason)
+
+		return nil, nil
+	}
+
+	info := variant.Info()
+
+	var alleles []gnoMADAllele
+	for _, allele := range normalized {
+		// Only concerned with SNVs, and INDELs.
+		if allele.class() == "" {
+			r.stats.skipAllele(variant.Chromosome, variant.Pos, variant.Id(), allele.reference, allele.alternate, skipUnsupportedClass)
+
+			continue
+		}
+
+		var estimates []ancestryEstimate
+		if names.Chromosome(variant.Chromosome) != "MT" {
+			estimates, err = nuclearEstimates(info, r.schema, allele.index)
 		} else {
-			// gnoMADv3 mitochondrial variants are in a totally different format (╯°□°）╯︵ ┻━┻.
-			hetFrequency, err := info.Get("AF_het")
+			estimates, err = mtDNAEstimates(info, allele.index)
+		}
+		if isMalformed(err) {
+			return nil, err
+		} else if err != nil {
+			r.logger.Debug("Could not get variant frequency", "id", variant.Id(), "error", err)
+			r.stats.skipAllele(variant.Chromosome, variant.Pos, variant.Id(), allele.reference, allele.alternate, skipNoFrequency)
+
+			continue
+		}
+
+		for i := range estimates {
+			estimates[i].source = r.source
+		}
+
+		var karyotypeEstimates []karyotypeEstimate
+		if r.sexSpecific && isSexChromosome(variant.Chromosome) {
+			karyotypeEstimates, err = nuclearKaryotypeEstimates(info, r.schema, allele.index)
 			if err != nil {
-				logger.Warn("Could not get variant frequency", "error", err)
-				continue
+				return nil, err
 			}
 
-			homFrequency, err := info.Get("AF_hom")
-			if err != nil {
-				logger.Warn("Could not get variant frequency", "error", err)
-				continue
+			for i := range karyotypeEstimates {
+				karyotypeEstimates[i].source = r.source
 			}
+		}
 
-			overallFrequency := hetFrequency.(float64) + homFrequency.(float64)
+		alleles = append(alleles, gnoMADAllele{
+			chromosome:         variant.Chromosome,
+			pos:                variant.Pos,
+			ids:                ids,
+			reference:          allele.reference,
+			alternate:          allele.alternate,
+			estimates:          estimates,
+			karyotypeEstimates: karyotypeEstimates,
+		})
+	}
 
-			// Not concerned with very rare variants.
-			if overallFrequency < minumumFrequency {
-				continue
-			}
+	return alleles, nil
+}
 
-			// Bit of a horrible hack using the vep field to get the variant type here.
-			vep, err := info.Get("vep")
-			if err != nil {
-				logger.Warn("Could not get variant type", "error", err)
+// joinAlleles combines the exome and genome alleles at a site.
+func joinAlleles(exomes, genomes []gnoMADAllele) []gnoMADAllele {
+	joined := make([]gnoMADAllele, 0, len(exomes)+len(genomes))
 
-				continue
-			}
+	matched := make([]bool, len(genomes))
+	for _, exome := range exomes {
+		i := slices.IndexFunc(genomes, func(genome gnoMADAllele) bool {
+			return genome.reference == exome.reference && genome.alternate == exome.alternate
+		})
+		if i < 0 {
+			joined = append(joined, exome)
+			continue
+		}
+		matched[i] = true
 
-			// Only concerned with SNVs, and INDELs.
-			if !strings.Contains(vep.(string), "insertion") &&
-				!strings.Contains(vep.(string), "deletion") &&
-				!strings.Contains(vep.(string), "SNV") {
-				continue
-			}
+		joined = append(joined, joinAllele(exome, genomes[i]))
+	}
 
-			if len(variant.Alt()) != 1 {
-				continue
+	for i, genome := range genomes {
+		if !matched[i] {
+			joined = append(joined, genome)
+		}
+	}
+
+	return joined
+}
+
+// joinAllele combines the estimates of the same allele from two datasets.
+func joinAllele(a, b gnoMADAllele) gnoMADAllele {
+	joined := gnoMADAllele{
+		chromosome: a.chromosome,
+		pos:        a.pos,
+		ids:        slices.Clone(a.ids),
+		reference:  a.reference,
+		alternate:  a.alternate,
+	}
+
+	for _, id := range b.ids {
+		if !slices.Contains(joined.ids, id) {
+			joined.ids = append(joined.ids, id)
+		}
+	}
+
+	joined.estimates = joinEstimates(a.estimates, b.estimates,
+		func(e ancestryEstimate) types.AncestryGroup { return e.ancestry },
+		ancestryEstimate.join)
+
+	joined.karyotypeEstimates = joinEstimates(a.karyotypeEstimates, b.karyotypeEstimates,
+		func(e karyotypeEstimate) karyotypeEstimateKey { return karyotypeEstimateKey{e.ancestry, e.karyotype} },
+		karyotypeEstimate.join)
+
+	joined.datasetEstimates = append(slices.Clone(a.estimates), b.estimates...)
+	joined.datasetKaryotypeEstimates = append(slices.Clone(a.karyotypeEstimates), b.karyotypeEstimates...)
+
+	return joined
+}
+
+// joinEstimates joins the estimates from two datasets which share the same
+// key, estimates only present in one of the datasets are kept as is.
+func joinEstimates[E any, K comparable](a, b []E, key func(E) K, join func(E, E) E) []E {
+	joined := make([]E, 0, len(a)+len(b))
+
+	matched := make([]bool, len(b))
+	for _, estimate := range a {
+		i := slices.IndexFunc(b, func(other E) bool {
+			return key(other) == key(estimate)
+		})
+		if i >= 0 {
+			matched[i] = true
+			estimate = join(estimate, b[i])
+		}
+
+		joined = append(joined, estimate)
+	}
+
+	for i, estimate := range b {
+		if !matched[i] {
+			joined = append(joined, estimate)
+		}
+	}
+
+	return joined
+}
+
+// ancestryEstimate is an estimate of an allele's frequency in an ancestry group.
+type ancestryEstimate struct {
+	ancestry  types.AncestryGroup
+	frequency float64
+	source    store.AlleleSource
+	// The counts the frequency was computed from (if known).
+	alleleCount  *int64
+	alleleNumber *int64
+	// The number of homozygous individuals (nuclear variants only).
+	homozygoteCount *int64
+	// The number of homoplasmic, and heteroplasmic individuals (mitochondrial
+	// variants only).
+	homoplasmicCount   *int64
+	heteroplasmicCount *int64
+}
+
+// join combines two estimates from different datasets into a joint estimate.
+// If either lacks allele counts they can't be combined, and the receiver is
+// returned unchanged.
+func (e ancestryEstimate) join(other ancestryEstimate) ancestryEstimate {
+	if e.alleleCount == nil || e.alleleNumber == nil || other.alleleCount == nil || other.alleleNumber == nil {
+		return e
+	}
+
+	alleleCount := *e.alleleCount + *other.alleleCount
+	alleleNumber := *e.alleleNumber + *other.alleleNumber
+
+	joined := ancestryEstimate{
+		ancestry:           e.ancestry,
+		source:             store.AlleleSourceJoint,
+		alleleCount:        &alleleCount,
+		alleleNumber:       &alleleNumber,
+		homozygoteCount:    sumCounts(e.homozygoteCount, other.homozygoteCount),
+		homoplasmicCount:   sumCounts(e.homoplasmicCount, other.homoplasmicCount),
+		heteroplasmicCount: sumCounts(e.heteroplasmicCount, other.heteroplasmicCount),
+	}
+
+	if alleleNumber > 0 {
+		joined.frequency = float64(alleleCount) / float64(alleleNumber)
+	}
+
+	return joined
+}
+
+// sumCounts adds two optional counts, the sum is only known if both are.
+func sumCounts(a, b *int64) *int64 {
+	if a == nil || b == nil {
+		return nil
+	}
+
+	sum := *a + *b
+	return &sum
+}
+
+// record returns the stored form of an estimate of an allele's frequency.
+func (e ancestryEstimate) record(id int64, allele gnoMADAllele) store.AlleleEstimate {
+	return store.AlleleEstimate{
+		ID:                 id,
+		Reference:          allele.reference,
+		Alternate:          allele.alternate,
+		Ancestry:           e.ancestry,
+		Source:             e.source,
+		AlleleCount:        e.alleleCount,
+		AlleleNumber:       e.alleleNumber,
+		HomozygoteCount:    e.homozygoteCount,
+		HomoplasmicCount:   e.homoplasmicCount,
+		HeteroplasmicCount: e.heteroplasmicCount,
+	}
+}
+
+// storedEstimate returns the estimate (sans frequency) of a stored record.
+func storedEstimate(record store.AlleleEstimate) ancestryEstimate {
+	return ancestryEstimate{
+		ancestry:           record.Ancestry,
+		source:             record.Source,
+		alleleCount:        record.AlleleCount,
+		alleleNumber:       record.AlleleNumber,
+		homozygoteCount:    record.HomozygoteCount,
+		homoplasmicCount:   record.HomoplasmicCount,
+		heteroplasmicCount: record.HeteroplasmicCount,
+	}
+}
+
+// nuclearEstimates returns the frequency of the alternate allele (at the
+// given index) in each ancestry group. The overall estimate comes first.
+func nuclearEstimates(info interfaces.Info, schema *gnoMADSchema, index int) ([]ancestryEstimate, error) {
+	if len(schema.frequencyKeys) == 0 {
+		return nil, fmt.Errorf("gnoMAD %s schema has no nuclear allele frequencies", schema.version)
+	}
+
+	estimates := make([]ancestryEstimate, 0, len(schema.frequencyKeys))
+	for i, ak := range schema.frequencyKeys {
+		estimate, err := nuclearEstimate(info, ak, index)
+		if err != nil {
+			// Only the overall frequency is mandatory.
+			if i == 0 || isMalformed(err) {
+				return nil, err
 			}
 
-			populationHetFrequencies, err := info.Get("pop_AF_het")
+			continue
+		}
+
+		estimates = append(estimates, estimate)
+	}
+
+	return estimates, nil
+}
+
+// nuclearEstimate returns the frequency (and counts) of the alternate allele
+// (at the given index) held in an ancestry group's INFO fields.
+func nuclearEstimate(info interfaces.Info, ak ancestryKey, index int) (ancestryEstimate, error) {
+	frequency, err := infoFloat(info, ak.key, index)
+	if err != nil {
+		return ancestryEstimate{}, err
+	}
+
+	estimate := ancestryEstimate{
+		ancestry:  ak.ancestry,
+		frequency: frequency,
+	}
+
+	// Allele counts are optional (but needed for joint estimates).
+	alleleCount, acErr := infoCount(info, countKey(ak.key, "AC"), index)
+	alleleNumber, anErr := infoCount(info, countKey(ak.key, "AN"), 0)
+	homozygoteCount, homErr := infoCount(info, countKey(ak.key, "nhomalt"), index)
+	for _, err := range []error{acErr, anErr, homErr} {
+		if isMalformed(err) {
+			return ancestryEstimate{}, err
+		}
+	}
+
+	if acErr == nil && anErr == nil {
+		estimate.alleleCount = &alleleCount
+		estimate.alleleNumber = &alleleNumber
+	}
+
+	if homErr == nil {
+		estimate.homozygoteCount = &homozygoteCount
+	}
+
+	return estimate, nil
+}
+
+// mtDNAEstimates returns the frequency of the alternate allele (at the
+// given index) in each ancestry group, for gnoMAD mitochondrial variants.
+// The overall estimate comes first.
+func mtDNAEstimates(info interfaces.Info, index int) ([]ancestryEstimate, error) {
+	// gnoMADv3 mitochondrial variants are in a totally different format (╯°□°）╯︵ ┻━┻.
+	hetFrequency, err := infoFloat(info, "AF_het", index)
+	if err != nil {
+		return nil, err
+	}
+
+	homFrequency, err := infoFloat(info, "AF_hom", index)
+	if err != nil {
+		return nil, err
+	}
+
+	populationFrequencies := make(map[types.AncestryGroup]float64)
+	for _, key := range []string{"pop_AF_het", "pop_AF_hom"} {
+		values, err := mtDNAPopulationValues(info, key, index)
+		if err != nil {
+			return nil, err
+		}
+
+		for ancestry, populationFrequencyStr := range values {
+			populationFrequency, err := strconv.ParseFloat(populationFrequencyStr, 64)
 			if err != nil {
-				logger.Warn("Could not get het variant frequency", "error", err)
-				continue
+				return nil, &fieldError{field: key, err: err}
 			}
 
-			populationHomFrequencies, err := info.Get("pop_AF_hom")
-			if err != nil {
-				logger.Warn("Could not get hom variant frequency", "error", err)
+			populationFrequencies[ancestry] += populationFrequency
+		}
+	}
+
+	// Counts are optional (but needed for joint estimates).
+	populationCounts := make(map[types.AncestryGroup]mtDNACounts)
+
+	homoplasmicCount, homErr := infoCount(info, "AC_hom", index)
+	heteroplasmicCount, hetErr := infoCount(info, "AC_het", index)
+	alleleNumber, anErr := infoCount(info, "AN", 0)
+	if homErr == nil && hetErr == nil && anErr == nil {
+		populationCounts[types.AncestryGroupAll] = mtDNACounts{homoplasmicCount, heteroplasmicCount, alleleNumber}
+	}
+
+	homCounts, homErr := mtDNAPopulationValues(info, "pop_AC_hom", index)
+	hetCounts, hetErr := mtDNAPopulationValues(info, "pop_AC_het", index)
+	alleleNumbers, anErr := mtDNAPopulationValues(info, "pop_AN", 0)
+	if homErr == nil && hetErr == nil && anErr == nil {
+		for ancestry := range homCounts {
+			homoplasmicCount, homErr := strconv.ParseInt(homCounts[ancestry], 10, 64)
+			heteroplasmicCount, hetErr := strconv.ParseInt(hetCounts[ancestry], 10, 64)
+			alleleNumber, anErr := strconv.ParseInt(alleleNumbers[ancestry], 10, 64)
+			if homErr != nil || hetErr != nil || anErr != nil {
 				continue
 			}
 
-			populationFrequencies := make(map[types.AncestryGroup]float64)
-			for i, populationHetFrequencyStr := range strings.Split(populationHetFrequencies.(string), "|") {
-				populationHetFrequency, err := strconv.ParseFloat(populationHetFrequencyStr, 64)
-				if err != nil {
-					logger.Warn("Could not parse variant frequency", "error", err)
+			populationCounts[ancestry] = mtDNACounts{homoplasmicCount, heteroplasmicCount, alleleNumber}
+		}
+	}
+
+	estimates := make([]ancestryEstimate, 0, len(ancestryGroups))
+	for _, ancestry := range ancestryGroups {
+		frequency := populationFrequencies[ancestry]
+		if ancestry == types.AncestryGroupAll {
+			frequency = hetFrequency + homFrequency
+		}
+
+		estimate := ancestryEstimate{
+			ancestry:  ancestry,
+			frequency: frequency,
+		}
+
+		if counts, ok := populationCounts[ancestry]; ok {
+			alleleCount := counts.homoplasmic + counts.heteroplasmic
+
+			estimate.alleleCount = &alleleCount
+			estimate.alleleNumber = &counts.alleleNumber
+			estimate.homoplasmicCount = &counts.homoplasmic
+			estimate.heteroplasmicCount = &counts.heteroplasmic
+		}
+
+		estimates = append(estimates, estimate)
+	}
+
+	return estimates, nil
+}
+
+// mtDNAPopulationValues returns the pipe separated per population values (for
+// the allele at the given index) of a gnoMAD mitochondrial INFO field, keyed
+// by ancestry group.
+func mtDNAPopulationValues(info interfaces.Info, key string, index int) (map[types.AncestryGroup]string, error) {
+	valuesStr, ok := infoString(info, key)
+	if !ok {
+		return nil, fmt.Errorf("missing %s", key)
+	}
+
+	// Per allele values are comma separated.
+	perAllele := strings.Split(valuesStr, ",")
+	if index >= len(perAllele) {
+		return nil, fmt.Errorf("no value for allele %d in %s", index, key)
+	}
+
+	values := make(map[types.AncestryGroup]string)
+	for i, value := range strings.Split(perAllele[index], "|") {
+		if i >= len(mtDNAAncestryGroups) {
+			break
+		}
+
+		values[mtDNAAncestryGroups[i]] = value
+	}
+
+	return values, nil
+}
+
+// mtDNACounts are the allele counts of a mitochondrial variant.
+type mtDNACounts struct {
+	homoplasmic   int64
+	heteroplasmic int64
+	alleleNumber  int64
+}
+
+// alleleWriter stores batches of gnoMAD alleles in the genobase, along with
+// the provenance of their estimates.
+type alleleWriter struct {
+	db      *genobase.DB
+	st      *store.DB
+	opts    GnoMADOptions
+	stats   *Stats
+	batch   *batcher
+	pending []gnoMADAllele
+}
+
+func (w *alleleWriter) write(ctx context.Context, alleles []gnoMADAllele) error {
+	for _, allele := range alleles {
+		// Not concerned with very rare variants (although joining with stored
+		// estimates may change the overall frequency).
+		if !w.opts.Joint && allele.estimates[0].frequency < w.opts.MinimumFrequency {
+			w.skip(allele, skipLowFrequency)
+
+			continue
+		}
+
+		w.pending = append(w.pending, allele)
+		w.batch.add(allele.rows())
+	}
+
+	if w.batch.full() {
+		return w.flush(ctx)
+	}
+
+	return nil
+}
+
+func (w *alleleWriter) flush(ctx context.Context) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	defer func() {
+		w.pending = w.pending[:0]
+		w.batch.reset()
+	}()
+
+	// Link alleles to the current RSIDs of any merged variants.
+	if err := resolveAlleleIDs(ctx, w.st, w.pending); err != nil {
+		return fmt.Errorf("could not resolve merged alleles: %w", err)
+	}
+
+	if w.opts.Joint {
+		if err := joinStoredEstimates(ctx, w.st, w.pending); err != nil {
+			return fmt.Errorf("could not join stored estimates: %w", err)
+		}
+	}
+
+	type alleleKey struct {
+		id                   int64
+		reference, alternate string
+		ancestry             types.AncestryGroup
+		karyotype            store.Karyotype
+		source               store.AlleleSource
+	}
+
+	var stored int
+	seen := make(map[alleleKey]bool)
+	var alleles []types.Allele
+	var estimates, staleEstimates []store.AlleleEstimate
+	var karyotypeEstimates, staleKaryotypeEstimates []store.AlleleKaryotypeEstimate
+	for _, allele := range w.pending {
+		// The first estimate is always the overall one.
+		if allele.estimates[0].frequency < w.opts.MinimumFrequency {
+			w.skip(allele, skipLowFrequency)
+
+			continue
+		}
+		stored++
+
+		for _, estimate := range allele.estimates {
+			for _, id := range allele.ids {
+				key := alleleKey{id, allele.reference, allele.alternate, estimate.ancestry, "", estimate.source}
+				if seen[key] {
 					continue
 				}
+				seen[key] = true
+
+				// Conserve space by rounding ancestry group frequencies down to
+				// zero where appropriate (their counts are still recorded, for
+				// joint estimates).
+				if estimate.frequency > w.opts.MinimumFrequency/100.0 {
+					alleles = append(alleles, types.Allele{
+						ID:        id,
+						Reference: allele.reference,
+						Alternate: allele.alternate,
+						Ancestry:  estimate.ancestry,
+						Frequency: estimate.frequency,
+					})
+				}
+
+				record := estimate.record(id, allele)
+				estimates = append(estimates, record)
 
-				populationFrequencies[mtDNAAncestryGroups[i]] += populationHetFrequency
+				// The frequency is no longer a joint one.
+				if _, ok := otherSource(estimate.source); ok {
+					record.Source = store.AlleleSourceJoint
+					staleEstimates = append(staleEstimates, record)
+				}
 			}
+		}
 
-			for i, populationHomFrequencyStr := range strings.Split(populationHomFrequencies.(string), "|") {
-				populationHomFrequency, err := strconv.ParseFloat(populationHomFrequencyStr, 64)
-				if err != nil {
-					logger.Warn("Could not parse variant frequency", "error", err)
+		for _, estimate := range allele.karyotypeEstimates {
+			for _, id := range allele.ids {
+				key := alleleKey{id, allele.reference, allele.alternate, estimate.ancestry, estimate.karyotype, estimate.source}
+				if seen[key] {
 					continue
 				}
+				seen[key] = true
+
+				record := estimate.record(id, allele)
+				karyotypeEstimates = append(karyotypeEstimates, record)
 
-				populationFrequencies[mtDNAAncestryGroups[i]] += populationHomFrequency
+				if _, ok := otherSource(estimate.source); ok {
+					record.Source = store.AlleleSourceJoint
+					staleKaryotypeEstimates = append(staleKaryotypeEstimates, record)
+				}
 			}
+		}
 
-			for _, ancestry := range ancestryGroups {
-				var frequency float64
-				if ancestry == types.AncestryGroupAll {
-					frequency = overallFrequency
-				} else {
-					frequency = populationFrequencies[ancestry]
+		for _, estimate := range allele.datasetEstimates {
+			for _, id := range allele.ids {
+				key := alleleKey{id, allele.reference, allele.alternate, estimate.ancestry, "", estimate.source}
+				if seen[key] {
+					continue
 				}
+				seen[key] = true
+
+				estimates = append(estimates, estimate.record(id, allele))
+			}
+		}
 
-				// Conserve space by rounding ancestry group frequencies down to zero where appropriate.
-				if frequency > minumumFrequency/100.0 {
-					for _, id := range ids {
-						alleles = append(alleles, types.Allele{
-							ID:        id,
-							Reference: variant.Ref(),
-							Alternate: variant.Alt()[0],
-							Ancestry:  ancestry,
-							Frequency: frequency,
-						})
-					}
+		for _, estimate := range allele.datasetKaryotypeEstimates {
+			for _, id := range allele.ids {
+				key := alleleKey{id, allele.reference, allele.alternate, estimate.ancestry, estimate.karyotype, estimate.source}
+				if seen[key] {
+					continue
 				}
+				seen[key] = true
+
+				karyotypeEstimates = append(karyotypeEstimates, estimate.record(id, allele))
 			}
 		}
+	}
 
-		if len(alleles) >= batchSize {
-			if err := db.StoreAlleles(ctx, alleles); err != nil {
-				return err
+	if len(estimates) == 0 {
+		return nil
+	}
+
+	err := w.batch.store(func() error {
+		if len(alleles) > 0 {
+			if err := w.db.StoreAlleles(ctx, alleles); err != nil {
+				return fmt.Errorf("could not store alleles: %w", err)
+			}
+		}
+
+		// Before storing the estimates, in case the batch has a joint
+		// estimate of the same allele.
+		if len(staleEstimates) > 0 {
+			if err := w.st.DeleteAlleleEstimates(ctx, staleEstimates); err != nil {
+				return fmt.Errorf("could not delete stale joint allele estimates: %w", err)
 			}
+		}
 
-			alleles = alleles[:0]
+		if len(staleKaryotypeEstimates) > 0 {
+			if err := w.st.DeleteAlleleKaryotypeEstimates(ctx, staleKaryotypeEstimates); err != nil {
+				return fmt.Errorf("could not delete stale joint allele karyotype estimates: %w", err)
+			}
 		}
+
+		if err := w.st.StoreAlleleEstimates(ctx, estimates); err != nil {
+			return fmt.Errorf("could not store allele estimates: %w", err)
+		}
+
+		if len(karyotypeEstimates) > 0 {
+			if err := w.st.StoreAlleleKaryotypeEstimates(ctx, karyotypeEstimates); err != nil {
+				return fmt.Errorf("could not store allele karyotype estimates: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.stats.stored(stored, unitAlleles)
+
+	return nil
+}
+
+// skip records that an allele was skipped.
+func (w *alleleWriter) skip(allele gnoMADAllele, reason string) {
+	if w.stats == nil {
+		return
+	}
+
+	ids := make([]string, len(allele.ids))
+	for i, id := range allele.ids {
+		ids[i] = "rs" + strconv.FormatInt(id, 10)
 	}
 
-	if len(alleles) > 0 {
-		if err := db.StoreAlleles(ctx, alleles); err != nil {
+	w.stats.skipAllele(allele.chromosome, allele.pos, strings.Join(ids, ";"), allele.reference, allele.alternate, reason)
+}
+
+// joinStoredEstimates combines a batch of allele estimates with those
+// previously imported from the other gnoMAD dataset. The estimates being
+// joined are kept (as dataset estimates) so they are stored too.
+func joinStoredEstimates(ctx context.Context, st *store.DB, alleles []gnoMADAllele) error {
+	var ids []int64
+	for _, allele := range alleles {
+		ids = append(ids, allele.ids...)
+	}
+
+	stored, err := st.AlleleEstimates(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var storedKaryotype []store.AlleleKaryotypeEstimate
+	if slices.ContainsFunc(alleles, func(allele gnoMADAllele) bool { return len(allele.karyotypeEstimates) > 0 }) {
+		if storedKaryotype, err = st.AlleleKaryotypeEstimates(ctx, ids); err != nil {
 			return err
 		}
 	}
 
+	type estimateKey struct {
+		id                   int64
+		reference, alternate string
+		ancestry             types.AncestryGroup
+		karyotype            store.Karyotype
+		source               store.AlleleSource
+	}
+
+	storedByKey := make(map[estimateKey]ancestryEstimate, len(stored)+len(storedKaryotype))
+	for _, record := range stored {
+		storedByKey[estimateKey{record.ID, record.Reference, record.Alternate, record.Ancestry, "", record.Source}] = storedEstimate(record)
+	}
+
+	for _, record := range storedKaryotype {
+		storedByKey[estimateKey{record.ID, record.Reference, record.Alternate, record.Ancestry, record.Karyotype, record.Source}] = storedEstimate(record.AlleleEstimate)
+	}
+
+	join := func(allele *gnoMADAllele, estimate ancestryEstimate, karyotype store.Karyotype) ancestryEstimate {
+		other, ok := otherSource(estimate.source)
+		if !ok {
+			return estimate
+		}
+
+		for _, id := range allele.ids {
+			if otherEstimate, ok := storedByKey[estimateKey{id, allele.reference, allele.alternate, estimate.ancestry, karyotype, other}]; ok {
+				return estimate.join(otherEstimate)
+			}
+		}
+
+		return estimate
+	}
+
+	for i := range alleles {
+		allele := &alleles[i]
+
+		allele.datasetEstimates = append(allele.datasetEstimates, allele.estimates...)
+		for j, estimate := range allele.estimates {
+			allele.estimates[j] = join(allele, estimate, "")
+		}
+
+		allele.datasetKaryotypeEstimates = append(allele.datasetKaryotypeEstimates, allele.karyotypeEstimates...)
+		for j, estimate := range allele.karyotypeEstimates {
+			allele.karyotypeEstimates[j].ancestryEstimate = join(allele, estimate.ancestryEstimate, estimate.karyotype)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,262 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// Columns of the GWAS Catalog associations TSV.
+const (
+	gwasColumnPubMedID           = "PUBMEDID"
+	gwasColumnTrait              = "DISEASE/TRAIT"
+	gwasColumnMappedTrait        = "MAPPED_TRAIT"
+	gwasColumnStudyAccession     = "STUDY ACCESSION"
+	gwasColumnRiskAllele         = "STRONGEST SNP-RISK ALLELE"
+	gwasColumnSNPs               = "SNPS"
+	gwasColumnCurrentSNPID       = "SNP_ID_CURRENT"
+	gwasColumnPValue             = "P-VALUE"
+	gwasColumnPValueText         = "P-VALUE (TEXT)"
+	gwasColumnEffectSize         = "OR or BETA"
+	gwasColumnConfidenceInterval = "95% CI (TEXT)"
+)
+
+// GWAS imports GWAS Catalog trait associations (from any number of files)
+// into the genobase. Any previously imported associations are replaced, but
+// only once every file has been imported (until then they are staged).
+func GWAS(ctx context.Context, logger *slog.Logger, st *store.DB, gwasPaths []string, batching BatchOptions, progress *Progress) error {
+	if err := st.ClearStagedGWASAssociations(ctx); err != nil {
+		return err
+	}
+
+	for _, gwasPath := range gwasPaths {
+		if err := stageGWAS(ctx, logger, st, gwasPath, batching, progress); err != nil {
+			// Don't leave a partial import behind.
+			return errors.Join(fmt.Errorf("could not import %s: %w", gwasPath, err), st.ClearStagedGWASAssociations(context.WithoutCancel(ctx)))
+		}
+	}
+
+	return st.ReplaceGWASAssociations(ctx)
+}
+
+// stageGWAS stages the trait associations of a GWAS Catalog file.
+func stageGWAS(ctx context.Context, logger *slog.Logger, st *store.DB, gwasPath string, batching BatchOptions, progress *Progress) error {
+	in, err := openInput(ctx, gwasPath, progress)
+	if err != nil {
+		return fmt.Errorf("could not open GWAS Catalog file: %w", err)
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+
+	header, err := readTSVLine(br)
+	if err != nil {
+		return fmt.Errorf("could not read header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range []string{gwasColumnPubMedID, gwasColumnTrait, gwasColumnRiskAllele, gwasColumnSNPs, gwasColumnPValue, gwasColumnEffectSize} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("missing required column %q", name)
+		}
+	}
+
+	batch := newBatcher(logger, batching)
+
+	var associations []store.GWASAssociation
+	for lineNumber := 2; ; lineNumber++ {
+		fields, err := readTSVLine(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("could not read line %d: %w", lineNumber, err)
+		}
+
+		column := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(fields) {
+				return ""
+			}
+
+			return strings.TrimSpace(fields[i])
+		}
+
+		kind, variants := gwasVariants(column(gwasColumnSNPs), column(gwasColumnRiskAllele))
+		if len(variants) == 0 {
+			logger.Debug("Skipping association without variants", "line", lineNumber)
+
+			continue
+		}
+
+		// The GWAS Catalog maps single variants to their current (post-merge) RSID.
+		if kind == store.GWASAssociationKindSingle {
+			if id, err := strconv.ParseInt(column(gwasColumnCurrentSNPID), 10, 64); err == nil {
+				variants[0].ID = &id
+			}
+		}
+
+		pubMedID, err := strconv.ParseInt(column(gwasColumnPubMedID), 10, 64)
+		if err != nil {
+			logger.Warn("Could not parse PubMed ID", "line", lineNumber, "error", err)
+
+			continue
+		}
+
+		association := store.GWASAssociation{
+			StudyAccession:     column(gwasColumnStudyAccession),
+			PubMedID:           pubMedID,
+			Trait:              column(gwasColumnTrait),
+			MappedTrait:        column(gwasColumnMappedTrait),
+			Kind:               kind,
+			PValue:             parseOptionalFloat(column(gwasColumnPValue)),
+			PValueText:         column(gwasColumnPValueText),
+			EffectSize:         parseOptionalFloat(column(gwasColumnEffectSize)),
+			ConfidenceInterval: column(gwasColumnConfidenceInterval),
+			Variants:           variants,
+		}
+		associations = append(associations, association)
+
+		// Each variant of an association is stored in its own row.
+		batch.add(1+len(variants), approximateRowBytes(association.StudyAccession, association.Trait,
+			association.MappedTrait, association.PValueText, association.ConfidenceInterval)+len(variants)*rowOverhead)
+
+		if batch.full() {
+			if err := batch.store(func() error { return st.StageGWASAssociations(ctx, associations) }); err != nil {
+				return fmt.Errorf("could not store gwas associations: %w", err)
+			}
+
+			associations = associations[:0]
+		}
+	}
+
+	if len(associations) > 0 {
+		if err := batch.store(func() error { return st.StageGWASAssociations(ctx, associations) }); err != nil {
+			return fmt.Errorf("could not store gwas associations: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// gwasVariants parses the SNPS and STRONGEST SNP-RISK ALLELE columns of an
+// association into its kind and list of variants.
+func gwasVariants(snps, strongestRiskAlleles string) (store.GWASAssociationKind, []store.GWASAssociationVariant) {
+	kind, snpList := splitGWASVariants(snps)
+
+	riskAlleles := make(map[string]string)
+	_, riskAlleleList := splitGWASVariants(strongestRiskAlleles)
+	for _, riskAllele := range riskAlleleList {
+		if i := strings.LastIndex(riskAllele, "-"); i > 0 {
+			riskAlleles[strings.ToLower(riskAllele[:i])] = riskAllele[i+1:]
+		}
+	}
+
+	// Some associations only list their variants in the risk allele column.
+	if len(snpList) == 0 {
+		kind, snpList = splitGWASVariants(strongestRiskAlleles)
+		for i, snp := range snpList {
+			if j := strings.LastIndex(snp, "-"); j > 0 {
+				snpList[i] = snp[:j]
+			}
+		}
+	}
+
+	var variants []store.GWASAssociationVariant
+	for _, snp := range snpList {
+		variant := store.GWASAssociationVariant{
+			SNP:        snp,
+			RiskAllele: riskAlleles[strings.ToLower(snp)],
+		}
+
+		if strings.HasPrefix(strings.ToLower(snp), "rs") {
+			if id, err := strconv.ParseInt(snp[2:], 10, 64); err == nil {
+				variant.ID = &id
+			}
+		}
+
+		variants = append(variants, variant)
+	}
+
+	return kind, variants
+}
+
+// splitGWASVariants splits a GWAS Catalog variant list, eg. "rs1 x rs2"
+// (an interaction) or "rs1; rs2" (a haplotype).
+func splitGWASVariants(s string) (store.GWASAssociationKind, []string) {
+	kind := store.GWASAssociationKindSingle
+
+	var parts []string
+	if strings.Contains(s, " x ") {
+		kind = store.GWASAssociationKindInteraction
+		parts = strings.Split(s, " x ")
+	} else {
+		parts = strings.FieldsFunc(s, func(r rune) bool {
+			return r == ';' || r == ','
+		})
+	}
+
+	var variants []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" && part != "NR" {
+			variants = append(variants, part)
+		}
+	}
+
+	if kind == store.GWASAssociationKindSingle && len(variants) > 1 {
+		kind = store.GWASAssociationKindHaplotype
+	}
+
+	return kind, variants
+}
+
+// readTSVLine reads a single line of a tab separated file.
+func readTSVLine(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimRight(line, "\r\n"), "\t"), nil
+}
+
+// parseOptionalFloat parses a float, returning nil if it is missing or invalid.
+func parseOptionalFloat(s string) *float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &f
+}
@@ -0,0 +1,189 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brentp/irelate/interfaces"
+	"github.com/brentp/vcfgo"
+)
+
+// fieldError is a malformed INFO field, as opposed to a missing one.
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.field, e.err)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// isMalformed returns whether an error is due to a malformed field.
+func isMalformed(err error) bool {
+	var fieldErr *fieldError
+	return errors.As(err, &fieldErr)
+}
+
+// infoGet returns the value of an INFO field. Missing fields return a plain
+// error, while fields that could not be parsed return a *fieldError.
+func infoGet(info interfaces.Info, key string) (value any, err error) {
+	if info == nil {
+		return nil, fmt.Errorf("missing %s", key)
+	}
+
+	// vcfgo panics on (some) values that don't match the header.
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, &fieldError{field: key, err: fmt.Errorf("%v", r)}
+		}
+	}()
+
+	// Get doesn't distinguish missing fields from invalid ones.
+	if infoByte, ok := info.(*vcfgo.InfoByte); ok && len(infoByte.SGet(key)) == 0 {
+		return nil, fmt.Errorf("missing %s", key)
+	}
+
+	value, err = info.Get(key)
+	if err != nil {
+		return nil, &fieldError{field: key, err: err}
+	}
+
+	return value, nil
+}
+
+// infoString returns the (comma joined) string value of an INFO field, and
+// whether the field was present.
+func infoString(info interfaces.Info, key string) (string, bool) {
+	value, err := infoGet(info, key)
+	if err != nil || value == nil {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case []string:
+		return strings.Join(v, ","), len(v) > 0
+	default:
+		return "", false
+	}
+}
+
+// infoFlag returns the value of a flag INFO field, absent flags are unset.
+func infoFlag(info interfaces.Info, key string) (bool, error) {
+	value, err := infoGet(info, key)
+	if err != nil {
+		if isMalformed(err) {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	flag, ok := value.(bool)
+	if !ok {
+		return false, &fieldError{field: key, err: fmt.Errorf("unexpected type %T", value)}
+	}
+
+	return flag, nil
+}
+
+// infoFloat returns the value of a float INFO field. For per allele
+// (Number=A) fields the index selects the alternate allele.
+func infoFloat(info interfaces.Info, key string, index int) (float64, error) {
+	var value any
+	// vcfgo quietly zeroes list values it can't parse, so parse them ourselves.
+	if infoByte, ok := info.(*vcfgo.InfoByte); ok {
+		raw := infoByte.SGet(key)
+		if len(raw) == 0 {
+			return 0, fmt.Errorf("missing %s", key)
+		}
+
+		value = string(raw)
+	} else {
+		var err error
+		value, err = infoGet(info, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var values []float64
+	switch v := value.(type) {
+	case float64:
+		values = []float64{v}
+	case float32:
+		values = []float64{float64(v)}
+	case int:
+		values = []float64{float64(v)}
+	case []float64:
+		values = v
+	case []float32:
+		for _, f := range v {
+			values = append(values, float64(f))
+		}
+	case []int:
+		for _, i := range v {
+			values = append(values, float64(i))
+		}
+	case string:
+		perAllele := strings.Split(v, ",")
+		if index < 0 || index >= len(perAllele) {
+			return 0, &fieldError{field: key, err: fmt.Errorf("no value for allele %d", index)}
+		}
+
+		if perAllele[index] == "." {
+			return 0, fmt.Errorf("missing %s for allele %d", key, index)
+		}
+
+		f, err := strconv.ParseFloat(perAllele[index], 64)
+		if err != nil {
+			return 0, &fieldError{field: key, err: err}
+		}
+
+		return f, nil
+	default:
+		return 0, &fieldError{field: key, err: fmt.Errorf("unexpected type %T", value)}
+	}
+
+	if index < 0 || index >= len(values) {
+		return 0, &fieldError{field: key, err: fmt.Errorf("no value for allele %d", index)}
+	}
+
+	return values[index], nil
+}
+
+// infoCount returns the value of an integer (count) INFO field, see infoFloat.
+func infoCount(info interfaces.Info, key string, index int) (int64, error) {
+	value, err := infoFloat(info, key, index)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(value), nil
+}
@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/zymatik-com/importer/internal/bgzf"
+	"github.com/zymatik-com/nucleo/compress"
+)
+
+// input is an opened, decompressed input file.
+type input struct {
+	io.Reader
+	f  *os.File
+	dr io.ReadCloser
+	// Set when the input is filtered (by region) in a separate goroutine.
+	pipe *io.PipeReader
+	wg   sync.WaitGroup
+	// Map offsets in the input to offsets in the file (see position), for
+	// inputs that don't start at the beginning of the file.
+	skipped    int64
+	bgzfReader *bgzf.Reader
+	bgzfBase   int64
+	bgzfDelta  int64
+}
+
+// openInput opens a (possibly compressed) input file, recording how much of
+// the file has been read in progress (if not nil), and hashing it if its
+// provenance is being recorded (see hashInput). BGZF compressed files are
+// decompressed in parallel.
+func openInput(ctx context.Context, path string, progress *Progress) (*input, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &input{f: f}
+
+	progress.start(path)
+
+	br := bufio.NewReaderSize(hashInput(ctx, path, f), bgzf.MaxBlockSize)
+
+	// Only errors if the file is too short, in which case it isn't BGZF.
+	header, _ := br.Peek(bgzf.HeaderSize)
+	if bgzf.IsBGZF(header) {
+		bgzfReader := bgzf.NewReader(br, runtime.NumCPU())
+
+		// Blocks are read ahead of being decompressed, so track progress as
+		// each block is consumed instead.
+		bgzfReader.Progress = progress.add
+
+		in.dr = bgzfReader
+		in.bgzfReader = bgzfReader
+	} else {
+		in.dr, err = compress.Decompress(progress.proxy(br))
+		if err != nil {
+			_ = in.Close()
+			return nil, fmt.Errorf("could not decompress file: %w", err)
+		}
+	}
+	in.Reader = in.dr
+
+	return in, nil
+}
+
+// position returns the offset in the decompressed file of an offset in the
+// input, and its BGZF virtual offset (if known). Filtered inputs have no
+// meaningful positions.
+func (in *input) position(offset int64) (int64, *bgzf.VirtualOffset, bool) {
+	if in.pipe != nil {
+		return 0, nil, false
+	}
+
+	var virtualOffset *bgzf.VirtualOffset
+	if in.bgzfReader != nil {
+		if v, ok := in.bgzfReader.VirtualOffset(offset + in.bgzfDelta); ok {
+			v = bgzf.NewVirtualOffset(in.bgzfBase+v.Block(), v.Offset())
+			virtualOffset = &v
+		}
+	}
+
+	return offset + in.skipped, virtualOffset, true
+}
+
+// Close closes the input file.
+func (in *input) Close() error {
+	if in.pipe != nil {
+		_ = in.pipe.Close()
+	}
+
+	if in.dr != nil {
+		_ = in.dr.Close()
+	}
+
+	err := in.f.Close()
+
+	// Wait for any filtering goroutine to notice the input has been closed.
+	in.wg.Wait()
+
+	return err
+}
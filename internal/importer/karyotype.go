@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"github.com/brentp/irelate/interfaces"
+	"github.com/zymatik-com/genobase/types"
+	"github.com/zymatik-com/importer/internal/store"
+	"github.com/zymatik-com/nucleo/names"
+)
+
+// karyotypeEstimate is an estimate of an allele's frequency in an ancestry
+// group, amongst individuals of a given karyotype.
+type karyotypeEstimate struct {
+	ancestryEstimate
+	karyotype store.Karyotype
+}
+
+// karyotypeEstimateKey identifies the group a karyotype estimate is for.
+type karyotypeEstimateKey struct {
+	ancestry  types.AncestryGroup
+	karyotype store.Karyotype
+}
+
+// join combines two karyotype estimates from different datasets into a
+// joint estimate (see ancestryEstimate.join).
+func (e karyotypeEstimate) join(other karyotypeEstimate) karyotypeEstimate {
+	return karyotypeEstimate{
+		ancestryEstimate: e.ancestryEstimate.join(other.ancestryEstimate),
+		karyotype:        e.karyotype,
+	}
+}
+
+// record returns the stored form of a karyotype estimate.
+func (e karyotypeEstimate) record(id int64, allele gnoMADAllele) store.AlleleKaryotypeEstimate {
+	return store.AlleleKaryotypeEstimate{
+		AlleleEstimate: e.ancestryEstimate.record(id, allele),
+		Karyotype:      e.karyotype,
+		Frequency:      e.frequency,
+	}
+}
+
+// nuclearKaryotypeEstimates returns the sex-specific frequencies of the
+// alternate allele (at the given index) in each ancestry group.
+func nuclearKaryotypeEstimates(info interfaces.Info, schema *gnoMADSchema, index int) ([]karyotypeEstimate, error) {
+	var estimates []karyotypeEstimate
+	for _, kk := range schema.karyotypeKeys {
+		// Not every site has a value for every group.
+		estimate, err := nuclearEstimate(info, kk.ancestryKey, index)
+		if isMalformed(err) {
+			return nil, err
+		} else if err != nil {
+			continue
+		}
+
+		estimates = append(estimates, karyotypeEstimate{
+			ancestryEstimate: estimate,
+			karyotype:        kk.karyotype,
+		})
+	}
+
+	return estimates, nil
+}
+
+// isSexChromosome reports whether a chromosome is X or Y (including their
+// pseudo-autosomal regions).
+func isSexChromosome(chromosome string) bool {
+	switch names.Chromosome(chromosome) {
+	case "X", "Y":
+		return true
+	default:
+		return false
+	}
+}
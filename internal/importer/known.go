@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// knownAlleleSet is the set of variant IDs we have allele frequencies for.
+// IDs are held in sorted slices (rather than a map) so the set takes 8 bytes
+// per ID, and its size is known before it is loaded.
+type knownAlleleSet struct {
+	ids []int64
+	// gnoMAD may reference RSIDs that have since been merged, these are
+	// their current IDs.
+	merged []int64
+}
+
+// loadKnownAlleles reads the IDs of the variants we have allele frequencies
+// for, logging how much memory they will take up front.
+func loadKnownAlleles(ctx context.Context, logger *slog.Logger, st *store.DB) (*knownAlleleSet, error) {
+	count, err := st.CountKnownAlleles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not count known alleles: %w", err)
+	}
+
+	logger.Info("Getting known alleles (this may take a while)",
+		"count", count, "memory", formatSize(count*8))
+
+	ids := make([]int64, 0, count)
+	err = st.KnownAlleles(ctx, func(id int64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get known alleles: %w", err)
+	}
+
+	merged, err := st.MergedKnownAlleles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve merged known alleles: %w", err)
+	}
+
+	if len(merged) > 0 {
+		logger.Debug("Resolved merged known alleles", "count", len(merged), "memory", formatSize(int64(len(merged))*8))
+	}
+
+	return &knownAlleleSet{ids: ids, merged: merged}, nil
+}
+
+// contains returns whether we have allele frequencies for a variant.
+func (s *knownAlleleSet) contains(id int64) bool {
+	if _, ok := slices.BinarySearch(s.ids, id); ok {
+		return true
+	}
+
+	_, ok := slices.BinarySearch(s.merged, id)
+	return ok
+}
@@ -23,35 +23,28 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os"
 
 	"github.com/zymatik-com/genobase"
 	"github.com/zymatik-com/genobase/types"
-	"github.com/zymatik-com/nucleo/compress"
 	"github.com/zymatik-com/nucleo/liftover"
 	"github.com/zymatik-com/nucleo/liftover/chainfile"
 )
 
 // LiftOverChain imports a lift over chain file into the genobase.
 func LiftOverChain(ctx context.Context, logger *slog.Logger, db *genobase.DB, from types.Reference, path string, showProgress bool) error {
-	f, err := os.Open(path)
+	// Storing the chain file displays its own progress.
+	in, err := openInput(ctx, path, nil)
 	if err != nil {
 		return fmt.Errorf("could not open chain file: %w", err)
 	}
-	defer f.Close()
+	defer in.Close()
 
-	dr, err := compress.Decompress(f)
-	if err != nil {
-		return fmt.Errorf("could not decompress chain file: %w", err)
-	}
-	defer dr.Close()
-
-	cf, err := chainfile.Read(dr)
+	cf, err := chainfile.Read(in)
 	if err != nil {
 		return err
 	}
 
-	if err := f.Close(); err != nil {
+	if err := in.Close(); err != nil {
 		return fmt.Errorf("could not close chain file: %w", err)
 	}
 
@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// refSNPMerged is the subset of a dbSNP RefSNP JSON record we care about.
+type refSNPMerged struct {
+	RefSNPID string `json:"refsnp_id"`
+	// Present on records which have been retired (refsnp-merged.json).
+	MergedSnapshotData *struct {
+		MergedInto []string `json:"merged_into"`
+	} `json:"merged_snapshot_data"`
+	// Present on current records which retired IDs have been merged into.
+	DBSNP1Merges []struct {
+		MergedRSID string `json:"merged_rsid"`
+	} `json:"dbsnp1_merges"`
+}
+
+// MergedRSIDs imports the dbSNP merge history into the genobase, so retired
+// RSIDs can be resolved to their current IDs. Both the RefSNP JSON format
+// (eg. refsnp-merged.json.bz2) and the legacy RsMergeArch table are supported.
+func MergedRSIDs(ctx context.Context, logger *slog.Logger, st *store.DB, mergedPath string, batching BatchOptions, progress *Progress) error {
+	in, err := openInput(ctx, mergedPath, progress)
+	if err != nil {
+		return fmt.Errorf("could not open dbSNP merge history file: %w", err)
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+
+	batch := newBatcher(logger, batching)
+
+	var n int64
+	var aliases []store.RSIDAlias
+	storeAlias := func(retiredID, currentID int64) error {
+		aliases = append(aliases, store.RSIDAlias{
+			RetiredID: retiredID,
+			CurrentID: currentID,
+		})
+		n++
+		batch.add(1, rowOverhead)
+
+		if batch.full() {
+			if err := batch.store(func() error { return st.StoreRSIDAliases(ctx, aliases) }); err != nil {
+				return fmt.Errorf("could not store rsid aliases: %w", err)
+			}
+
+			aliases = aliases[:0]
+		}
+
+		return nil
+	}
+
+	if isJSON, err := peekJSON(br); err != nil {
+		return fmt.Errorf("could not read dbSNP merge history file: %w", err)
+	} else if isJSON {
+		dec := json.NewDecoder(br)
+		for {
+			var record refSNPMerged
+			if err := dec.Decode(&record); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				return fmt.Errorf("could not decode refsnp record: %w", err)
+			}
+
+			id, err := strconv.ParseInt(record.RefSNPID, 10, 64)
+			if err != nil {
+				logger.Warn("Could not parse variant ID", "id", record.RefSNPID, "error", err)
+
+				continue
+			}
+
+			if record.MergedSnapshotData != nil && len(record.MergedSnapshotData.MergedInto) > 0 {
+				currentID, err := strconv.ParseInt(record.MergedSnapshotData.MergedInto[0], 10, 64)
+				if err != nil {
+					logger.Warn("Could not parse variant ID", "id", record.MergedSnapshotData.MergedInto[0], "error", err)
+
+					continue
+				}
+
+				if err := storeAlias(id, currentID); err != nil {
+					return err
+				}
+			}
+
+			for _, merge := range record.DBSNP1Merges {
+				retiredID, err := strconv.ParseInt(merge.MergedRSID, 10, 64)
+				if err != nil {
+					logger.Warn("Could not parse variant ID", "id", merge.MergedRSID, "error", err)
+
+					continue
+				}
+
+				if err := storeAlias(retiredID, id); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		// RsMergeArch columns: rsHigh, rsLow, build_id, orien, create_time,
+		// last_updated_time, rsCurrent, orien2Current, comment.
+		for {
+			fields, err := readTSVLine(br)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				return fmt.Errorf("could not read RsMergeArch file: %w", err)
+			}
+
+			if len(fields) < 2 {
+				continue
+			}
+
+			retiredID, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+			if err != nil {
+				logger.Warn("Could not parse variant ID", "id", fields[0], "error", err)
+
+				continue
+			}
+
+			currentIDStr := strings.TrimSpace(fields[1])
+			if len(fields) > 6 && strings.TrimSpace(fields[6]) != "" {
+				currentIDStr = strings.TrimSpace(fields[6])
+			}
+
+			currentID, err := strconv.ParseInt(currentIDStr, 10, 64)
+			if err != nil {
+				logger.Warn("Could not parse variant ID", "id", currentIDStr, "error", err)
+
+				continue
+			}
+
+			if err := storeAlias(retiredID, currentID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(aliases) > 0 {
+		if err := batch.store(func() error { return st.StoreRSIDAliases(ctx, aliases) }); err != nil {
+			return fmt.Errorf("could not store rsid aliases: %w", err)
+		}
+	}
+
+	logger.Info("Flattening RSID merge chains", "aliases", n)
+
+	if err := st.FlattenRSIDAliases(ctx); err != nil {
+		return fmt.Errorf("could not flatten rsid aliases: %w", err)
+	}
+
+	return nil
+}
+
+// peekJSON reports whether the reader contains JSON (rather than tab
+// separated) records.
+func peekJSON(br *bufio.Reader) (bool, error) {
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		switch c := b[i-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{', nil
+		}
+	}
+}
+
+// resolveAlleleIDs rewrites any retired RSIDs of a batch of gnoMAD alleles
+// to their current IDs.
+func resolveAlleleIDs(ctx context.Context, st *store.DB, alleles []gnoMADAllele) error {
+	var ids []int64
+	for _, allele := range alleles {
+		ids = append(ids, allele.ids...)
+	}
+
+	resolved, err := st.ResolveRSIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	if len(resolved) == 0 {
+		return nil
+	}
+
+	for i := range alleles {
+		var currentIDs []int64
+		for _, id := range alleles[i].ids {
+			if currentID, ok := resolved[id]; ok {
+				id = currentID
+			}
+
+			if !slices.Contains(currentIDs, id) {
+				currentIDs = append(currentIDs, id)
+			}
+		}
+
+		alleles[i].ids = currentIDs
+	}
+
+	return nil
+}
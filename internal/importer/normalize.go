@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zymatik-com/importer/internal/fasta"
+	"github.com/zymatik-com/nucleo/names"
+)
+
+// How many reference bases to fetch at a time when left-aligning.
+const leftAlignWindow = 64
+
+// errReferenceMismatch is returned when the reference allele of a record
+// doesn't match the reference sequence (eg. the wrong FASTA was given).
+var errReferenceMismatch = errors.New("reference allele doesn't match the reference sequence")
+
+// Classes of (normalized) biallelic alleles.
+const (
+	alleleClassSNV = "SNV"
+	alleleClassINS = "INS"
+	alleleClassDEL = "DEL"
+)
+
+// biallelic is a single reference/alternate allele pair decomposed from a
+// (possibly multi-allelic) VCF record.
+type biallelic struct {
+	// Index of the alternate allele in the original record (eg. for
+	// selecting values of Number=A INFO fields).
+	index     int
+	pos       uint64
+	reference string
+	alternate string
+}
+
+// class returns the class of the allele (SNV, INS, or DEL), or an empty
+// string for any other (eg. multi-nucleotide or complex) allele.
+func (a biallelic) class() string {
+	switch {
+	case a.reference == "" || a.alternate == "":
+		return ""
+	case len(a.reference) == 1 && len(a.alternate) == 1:
+		return alleleClassSNV
+	case len(a.reference) == 1 && a.alternate[0] == a.reference[0]:
+		return alleleClassINS
+	case len(a.alternate) == 1 && a.reference[0] == a.alternate[0]:
+		return alleleClassDEL
+	default:
+		return ""
+	}
+}
+
+// normalizer decomposes multi-allelic VCF records into biallelic alleles,
+// trimming them to their most parsimonious representation and (given a
+// reference sequence) left-aligning indels.
+type normalizer struct {
+	reference *fasta.Reader
+	// Normalized chromosome name to reference sequence name.
+	sequences map[string]string
+}
+
+// newNormalizer creates a new normalizer, the FASTA reference is optional
+// and if not provided indels will not be left-aligned.
+func newNormalizer(referenceFASTAPath string) (*normalizer, error) {
+	n := &normalizer{}
+
+	if referenceFASTAPath != "" {
+		var err error
+		n.reference, err = fasta.Open(referenceFASTAPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not open reference FASTA: %w", err)
+		}
+
+		n.sequences = make(map[string]string)
+		for _, name := range n.reference.Names() {
+			n.sequences[name] = name
+			if _, ok := n.sequences[names.Chromosome(name)]; !ok {
+				n.sequences[names.Chromosome(name)] = name
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close releases any resources held by the normalizer.
+func (n *normalizer) Close() error {
+	if n.reference != nil {
+		return n.reference.Close()
+	}
+
+	return nil
+}
+
+// normalize decomposes a VCF record into normalized biallelic alleles.
+// Symbolic, missing, and spanning deletion alleles are dropped. Given a
+// reference sequence, records whose reference allele doesn't match it are
+// rejected (errReferenceMismatch). It is safe to call concurrently.
+func (n *normalizer) normalize(chromosome string, pos uint64, reference string, alternates []string) ([]biallelic, error) {
+	sequence, err := n.sequence(chromosome)
+	if err != nil {
+		return nil, err
+	}
+
+	reference = strings.ToUpper(reference)
+
+	if sequence != "" && isBases(reference) {
+		bases, err := n.reference.Sequence(sequence, int64(pos), int64(pos)+int64(len(reference))-1)
+		if err != nil {
+			return nil, err
+		}
+
+		if !matchesReference(reference, bases) {
+			return nil, fmt.Errorf("%w: %s at %s:%d, expected %s", errReferenceMismatch, reference, chromosome, pos, bases)
+		}
+	}
+
+	alleles := make([]biallelic, 0, len(alternates))
+	for i, alternate := range alternates {
+		alternate = strings.ToUpper(alternate)
+
+		if reference == "" || !isBases(reference) || !isBases(alternate) || alternate == reference {
+			continue
+		}
+
+		a := biallelic{
+			index:     i,
+			pos:       pos,
+			reference: reference,
+			alternate: alternate,
+		}
+
+		if sequence != "" && len(a.reference) != len(a.alternate) {
+			if err := n.leftAlign(sequence, &a); err != nil {
+				return nil, err
+			}
+
+			// Can't anchor indels at the very start of a chromosome.
+			if a.reference == "" || a.alternate == "" {
+				continue
+			}
+		} else {
+			for len(a.reference) > 1 && len(a.alternate) > 1 && a.reference[len(a.reference)-1] == a.alternate[len(a.alternate)-1] {
+				a.reference = a.reference[:len(a.reference)-1]
+				a.alternate = a.alternate[:len(a.alternate)-1]
+			}
+		}
+
+		for len(a.reference) > 1 && len(a.alternate) > 1 && a.reference[0] == a.alternate[0] {
+			a.reference = a.reference[1:]
+			a.alternate = a.alternate[1:]
+			a.pos++
+		}
+
+		alleles = append(alleles, a)
+	}
+
+	return alleles, nil
+}
+
+// leftAlign shifts an indel as far left as possible, while keeping an anchor
+// base (as per Tan et al. 2015, "Unified representation of genetic variants").
+func (n *normalizer) leftAlign(sequence string, a *biallelic) error {
+	var window []byte
+	var windowStart uint64
+
+	for {
+		changed := false
+
+		if len(a.reference) > 0 && len(a.alternate) > 0 && a.reference[len(a.reference)-1] == a.alternate[len(a.alternate)-1] {
+			a.reference = a.reference[:len(a.reference)-1]
+			a.alternate = a.alternate[:len(a.alternate)-1]
+			changed = true
+		}
+
+		if len(a.reference) == 0 || len(a.alternate) == 0 {
+			if a.pos <= 1 {
+				break
+			}
+
+			a.pos--
+
+			if len(window) == 0 || a.pos < windowStart {
+				windowStart = uint64(max(int64(a.pos)-leftAlignWindow+1, 1))
+
+				var err error
+				window, err = n.reference.Sequence(sequence, int64(windowStart), int64(a.pos))
+				if err != nil {
+					return err
+				}
+
+				if uint64(len(window)) != a.pos-windowStart+1 {
+					return fmt.Errorf("position %d is beyond the end of reference sequence %s", a.pos, sequence)
+				}
+			}
+
+			base := string(window[a.pos-windowStart])
+			a.reference = base + a.reference
+			a.alternate = base + a.alternate
+			changed = true
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return nil
+}
+
+// sequence returns the name of the reference sequence for a chromosome, or an
+// empty string if there is no reference.
+func (n *normalizer) sequence(chromosome string) (string, error) {
+	if n.reference == nil {
+		return "", nil
+	}
+
+	if name, ok := n.sequences[chromosome]; ok {
+		return name, nil
+	}
+
+	if name, ok := n.sequences[names.Chromosome(chromosome)]; ok {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("chromosome %s not found in reference FASTA", chromosome)
+}
+
+// matchesReference reports whether an allele matches the bases of the
+// reference sequence at its position (N matches any base).
+func matchesReference(allele string, bases []byte) bool {
+	if len(allele) != len(bases) {
+		return false
+	}
+
+	for i := range bases {
+		if allele[i] != bases[i] && allele[i] != 'N' && bases[i] != 'N' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isBases reports whether an allele is made up only of nucleotide bases.
+func isBases(allele string) bool {
+	if allele == "" {
+		return false
+	}
+
+	for _, c := range allele {
+		switch c {
+		case 'A', 'C', 'G', 'T', 'N':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testFASTA is the reference sequence the normalizer tests are run against.
+//
+//	chr1: G A T T T T T C A C A  C  A  G  T
+//	      1 2 3 4 5 6 7 8 9 10 11 12 13 14 15
+//	chr2: G G A C
+const testFASTA = `>chr1
+GATTTTTCAC
+ACAGT
+>chr2
+GGAC
+`
+
+func newTestNormalizer(t *testing.T) *normalizer {
+	path := filepath.Join(t.TempDir(), "reference.fa")
+	if err := os.WriteFile(path, []byte(testFASTA), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := newNormalizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = n.Close() })
+
+	return n
+}
+
+func TestNormalize(t *testing.T) {
+	n := newTestNormalizer(t)
+
+	tests := []struct {
+		name       string
+		chromosome string
+		pos        uint64
+		reference  string
+		alternates []string
+		want       []biallelic
+	}{
+		{
+			name:       "SNV",
+			chromosome: "chr1",
+			pos:        14,
+			reference:  "G",
+			alternates: []string{"T"},
+			want:       []biallelic{{index: 0, pos: 14, reference: "G", alternate: "T"}},
+		},
+		{
+			name:       "homopolymer deletion",
+			chromosome: "chr1",
+			pos:        6,
+			reference:  "TT",
+			alternates: []string{"T"},
+			want:       []biallelic{{index: 0, pos: 2, reference: "AT", alternate: "A"}},
+		},
+		{
+			name:       "homopolymer insertion",
+			chromosome: "chr1",
+			pos:        7,
+			reference:  "T",
+			alternates: []string{"TT"},
+			want:       []biallelic{{index: 0, pos: 2, reference: "A", alternate: "AT"}},
+		},
+		{
+			name:       "repeat unit insertion",
+			chromosome: "chr1",
+			pos:        12,
+			reference:  "C",
+			alternates: []string{"CAC"},
+			want:       []biallelic{{index: 0, pos: 7, reference: "T", alternate: "TCA"}},
+		},
+		{
+			name:       "repeat unit deletion",
+			chromosome: "chr1",
+			pos:        11,
+			reference:  "ACA",
+			alternates: []string{"A"},
+			want:       []biallelic{{index: 0, pos: 7, reference: "TCA", alternate: "T"}},
+		},
+		{
+			name:       "multi-allelic",
+			chromosome: "chr1",
+			pos:        2,
+			reference:  "ATT",
+			alternates: []string{"A", "*", "ATTT", "<DEL>", "CTT"},
+			want: []biallelic{
+				{index: 0, pos: 2, reference: "ATT", alternate: "A"},
+				{index: 2, pos: 2, reference: "A", alternate: "AT"},
+				{index: 4, pos: 2, reference: "A", alternate: "C"},
+			},
+		},
+		{
+			name:       "shared prefix",
+			chromosome: "chr1",
+			pos:        13,
+			reference:  "AG",
+			alternates: []string{"AC"},
+			want:       []biallelic{{index: 0, pos: 14, reference: "G", alternate: "C"}},
+		},
+		{
+			name:       "deletion at the start of a chromosome",
+			chromosome: "chr2",
+			pos:        1,
+			reference:  "GG",
+			alternates: []string{"G"},
+			want:       []biallelic{},
+		},
+		{
+			name:       "insertion at the start of a chromosome",
+			chromosome: "chr2",
+			pos:        1,
+			reference:  "G",
+			alternates: []string{"GG", "T"},
+			want:       []biallelic{{index: 1, pos: 1, reference: "G", alternate: "T"}},
+		},
+		{
+			name:       "deletion next to the start of a chromosome",
+			chromosome: "chr2",
+			pos:        2,
+			reference:  "GA",
+			alternates: []string{"G"},
+			want:       []biallelic{{index: 0, pos: 2, reference: "GA", alternate: "G"}},
+		},
+		{
+			name:       "unprefixed chromosome name",
+			chromosome: "1",
+			pos:        6,
+			reference:  "tt",
+			alternates: []string{"t"},
+			want:       []biallelic{{index: 0, pos: 2, reference: "AT", alternate: "A"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := n.normalize(tt.chromosome, tt.pos, tt.reference, tt.alternates)
+			if err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalize = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeReferenceMismatch(t *testing.T) {
+	n := newTestNormalizer(t)
+
+	tests := []struct {
+		name      string
+		pos       uint64
+		reference string
+	}{
+		{name: "wrong base", pos: 2, reference: "C"},
+		{name: "wrong bases", pos: 6, reference: "TC"},
+		{name: "beyond the end", pos: 15, reference: "TA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := n.normalize("chr1", tt.pos, tt.reference, []string{"G"})
+			if !errors.Is(err, errReferenceMismatch) {
+				t.Errorf("normalize error = %v, want %v", err, errReferenceMismatch)
+			}
+		})
+	}
+}
+
+func TestNormalizeWithoutReference(t *testing.T) {
+	n, err := newNormalizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a reference, alleles are only trimmed (and not checked).
+	got, err := n.normalize("chr1", 100, "CAGT", []string{"CT", "GAGT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []biallelic{
+		{index: 0, pos: 100, reference: "CAG", alternate: "C"},
+		{index: 1, pos: 100, reference: "C", alternate: "G"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalize = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// The Genobase tables bulk loaded by each import, whose indexes can be
+// dropped while loading.
+var importTables = map[string][]string{
+	variantsImport: {"variant"},
+	"alleles":      {"allele"},
+}
+
+// DropIndexes drops the indexes of the tables an import loads, they are
+// built again by RestoreIndexes (or Optimize) once the import is complete.
+func DropIndexes(ctx context.Context, logger *slog.Logger, st *store.DB, importName string) error {
+	tables, ok := importTables[importName]
+	if !ok {
+		return fmt.Errorf("%s imports don't support dropping indexes", importName)
+	}
+
+	indexes, err := st.DropIndexes(ctx, tables)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		logger.Info("Dropped index", "name", index.Name, "table", index.Table)
+	}
+
+	return nil
+}
+
+// RestoreIndexes builds any indexes dropped by DropIndexes.
+func RestoreIndexes(ctx context.Context, logger *slog.Logger, st *store.DB) error {
+	indexes, err := st.DroppedIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		logger.Info("Building index (this may take a while)", "name", index.Name, "table", index.Table)
+
+		if err := st.RestoreIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OptimizeOptions are the options for optimizing a database.
+type OptimizeOptions struct {
+	// NoVacuum skips rebuilding the database file (the indexes are rebuilt
+	// in place instead).
+	NoVacuum bool
+	// VacuumInto, if set, writes the optimized database to a new file,
+	// rather than replacing the original.
+	VacuumInto string
+}
+
+// Optimize prepares a database for distribution. It builds any dropped
+// indexes, rebuilds the rest, gathers query planner statistics, and vacuums
+// the database, logging the change in its size.
+func Optimize(ctx context.Context, logger *slog.Logger, st *store.DB, dbPath string, opts OptimizeOptions) error {
+	if opts.NoVacuum && opts.VacuumInto != "" {
+		return fmt.Errorf("can't vacuum into a new file without vacuuming")
+	}
+
+	if opts.VacuumInto != "" {
+		if _, err := os.Stat(opts.VacuumInto); err == nil {
+			return fmt.Errorf("refusing to overwrite existing file: %s", opts.VacuumInto)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not stat %s: %w", opts.VacuumInto, err)
+		}
+	}
+
+	sizeBefore, err := fileSize(dbPath)
+	if err != nil {
+		return err
+	}
+
+	if err := RestoreIndexes(ctx, logger, st); err != nil {
+		return err
+	}
+
+	// Vacuuming rebuilds the indexes anyway.
+	if opts.NoVacuum {
+		logger.Info("Rebuilding indexes (this may take a while)")
+
+		if err := st.Reindex(ctx); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Analyzing database")
+
+	if err := st.Analyze(ctx); err != nil {
+		return err
+	}
+
+	optimizedPath := dbPath
+	if opts.VacuumInto != "" {
+		optimizedPath = opts.VacuumInto
+	}
+
+	if !opts.NoVacuum {
+		logger.Info("Vacuuming database (this may take a while)", "path", optimizedPath)
+
+		if err := st.Vacuum(ctx, opts.VacuumInto); err != nil {
+			return err
+		}
+	}
+
+	sizeAfter, err := fileSize(optimizedPath)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Optimized database", "path", optimizedPath,
+		"size_before", formatSize(sizeBefore), "size_after", formatSize(sizeAfter),
+		"change", fmt.Sprintf("%+.1f%%", 100*float64(sizeAfter-sizeBefore)/float64(max(sizeBefore, 1))))
+
+	return nil
+}
+
+// fileSize returns the size of a database file.
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not stat %s: %w", path, err)
+	}
+
+	return fi.Size(), nil
+}
+
+// formatSize formats a number of bytes for logging.
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
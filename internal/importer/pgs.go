@@ -0,0 +1,312 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/zymatik-com/genobase/types"
+	"github.com/zymatik-com/importer/internal/store"
+	"github.com/zymatik-com/nucleo/names"
+)
+
+// PGS imports a PGS Catalog (harmonized) scoring file into the genobase.
+func PGS(ctx context.Context, logger *slog.Logger, st *store.DB, pgsPath string, batching BatchOptions, progress *Progress) error {
+	in, err := openInput(ctx, pgsPath, progress)
+	if err != nil {
+		return fmt.Errorf("could not open PGS Catalog scoring file: %w", err)
+	}
+	defer in.Close()
+
+	br := bufio.NewReader(in)
+
+	// Read the metadata header (eg. "#pgs_id=PGS000001").
+	metadata := make(map[string]string)
+	var header []string
+	for {
+		fields, err := readTSVLine(br)
+		if err != nil {
+			return fmt.Errorf("could not read header: %w", err)
+		}
+
+		if !strings.HasPrefix(fields[0], "#") {
+			header = fields
+			break
+		}
+
+		line := strings.TrimLeft(strings.Join(fields, "\t"), "#")
+		if key, value, ok := strings.Cut(line, "="); ok {
+			metadata[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range []string{"effect_allele", "effect_weight"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("missing required column %q", name)
+		}
+	}
+
+	score := store.PGSScore{
+		ID:              metadata["pgs_id"],
+		Name:            metadata["pgs_name"],
+		TraitReported:   metadata["trait_reported"],
+		TraitMapped:     metadata["trait_mapped"],
+		TraitEFO:        metadata["trait_efo"],
+		WeightType:      metadata["weight_type"],
+		GenomeBuild:     metadata["genome_build"],
+		HarmonizedBuild: metadata["HmPOS_build"],
+		PublicationID:   metadata["pgp_id"],
+		Citation:        metadata["citation"],
+		License:         metadata["license"],
+	}
+
+	if score.ID == "" {
+		return fmt.Errorf("missing pgs_id in scoring file header")
+	}
+
+	if score.VariantsNumber, err = strconv.ParseInt(metadata["variants_number"], 10, 64); err != nil {
+		logger.Warn("Could not parse number of variants", "error", err)
+	}
+
+	if err := st.StorePGSScore(ctx, score); err != nil {
+		return fmt.Errorf("could not store pgs score: %w", err)
+	}
+
+	// Weights without a (known) RSID can still be found by their position, if
+	// it is relative to the same assembly as the variants.
+	variantsReference, _, err := st.Metadata(ctx, store.MetadataVariantsReference)
+	if err != nil {
+		return fmt.Errorf("could not get variants reference: %w", err)
+	}
+
+	asm := assemblies[types.Reference(variantsReference)]
+	harmonizedPositions := asm != nil && pgsReference(score.HarmonizedBuild) == types.Reference(variantsReference)
+	originalPositions := asm != nil && pgsReference(score.GenomeBuild) == types.Reference(variantsReference)
+
+	var stored, missing, ambiguous int64
+
+	storeWeights := func(weights []store.PGSWeight, loci []*store.Locus) error {
+		if err := resolveWeightIDs(ctx, st, weights); err != nil {
+			return fmt.Errorf("could not resolve merged rsids: %w", err)
+		}
+
+		var ids []int64
+		for _, weight := range weights {
+			if weight.ID != nil {
+				ids = append(ids, *weight.ID)
+			}
+		}
+
+		existing, err := st.ExistingVariants(ctx, ids)
+		if err != nil {
+			return fmt.Errorf("could not check for existing variants: %w", err)
+		}
+
+		var unknownLoci []store.Locus
+		for i, weight := range weights {
+			if (weight.ID == nil || !existing[*weight.ID]) && loci[i] != nil {
+				unknownLoci = append(unknownLoci, *loci[i])
+			}
+		}
+
+		var found map[store.Locus][]int64
+		if len(unknownLoci) > 0 {
+			found, err = st.VariantsAt(ctx, unknownLoci)
+			if err != nil {
+				return fmt.Errorf("could not find variants by position: %w", err)
+			}
+		}
+
+		for i, weight := range weights {
+			if weight.ID != nil && existing[*weight.ID] {
+				continue
+			}
+
+			var variantIDs []int64
+			if loci[i] != nil {
+				variantIDs = found[*loci[i]]
+			}
+
+			switch len(variantIDs) {
+			case 0:
+				missing++
+			case 1:
+				// Link the weight to the only variant at its position (in place
+				// of an rsid that isn't in the database).
+				weights[i].ID = &variantIDs[0]
+			default:
+				// There's no telling which of the variants at its position the
+				// weight is for.
+				ambiguous++
+			}
+		}
+
+		if err := st.StorePGSWeights(ctx, weights); err != nil {
+			return fmt.Errorf("could not store pgs weights: %w", err)
+		}
+
+		stored += int64(len(weights))
+
+		return nil
+	}
+
+	batch := newBatcher(logger, batching)
+
+	var weights []store.PGSWeight
+	var loci []*store.Locus
+	for lineNumber := int64(1); ; lineNumber++ {
+		fields, err := readTSVLine(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("could not read scoring file: %w", err)
+		}
+
+		column := func(names ...string) string {
+			for _, name := range names {
+				if i, ok := columns[name]; ok && i < len(fields) {
+					if value := strings.TrimSpace(fields[i]); value != "" {
+						return value
+					}
+				}
+			}
+
+			return ""
+		}
+
+		weight, err := strconv.ParseFloat(column("effect_weight"), 64)
+		if err != nil {
+			logger.Warn("Could not parse effect weight", "line", lineNumber, "error", err)
+
+			continue
+		}
+
+		pgsWeight := store.PGSWeight{
+			ScoreID:      score.ID,
+			Index:        lineNumber,
+			Chromosome:   column("hm_chr", "chr_name"),
+			EffectAllele: column("effect_allele"),
+			OtherAllele:  column("other_allele", "hm_inferOtherAllele"),
+			Weight:       weight,
+		}
+
+		// Prefer the harmonized RSID and position.
+		if rsID := column("hm_rsID", "rsID"); strings.HasPrefix(rsID, "rs") {
+			if id, err := strconv.ParseInt(strings.TrimPrefix(rsID, "rs"), 10, 64); err == nil {
+				pgsWeight.ID = &id
+			}
+		}
+
+		if position, err := strconv.ParseInt(column("hm_pos", "chr_position"), 10, 64); err == nil {
+			pgsWeight.Position = &position
+		}
+
+		var locus *store.Locus
+		if harmonized := column("hm_pos") != ""; pgsWeight.Position != nil && (harmonized && harmonizedPositions || !harmonized && originalPositions) {
+			locus = asm.locus(pgsWeight.Chromosome, *pgsWeight.Position)
+		}
+
+		weights = append(weights, pgsWeight)
+		loci = append(loci, locus)
+		batch.add(1, approximateRowBytes(pgsWeight.Chromosome, pgsWeight.EffectAllele, pgsWeight.OtherAllele))
+
+		if batch.full() {
+			if err := batch.store(func() error { return storeWeights(weights, loci) }); err != nil {
+				return err
+			}
+
+			weights = weights[:0]
+			loci = loci[:0]
+		}
+	}
+
+	if len(weights) > 0 {
+		if err := batch.store(func() error { return storeWeights(weights, loci) }); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Imported polygenic score", "id", score.ID, "variants", stored, "missing", missing, "ambiguous", ambiguous)
+
+	if missing > 0 {
+		logger.Warn("Some score variants are not present in the database",
+			"id", score.ID, "missing", missing, "percent", fmt.Sprintf("%.2f", 100*float64(missing)/float64(stored)))
+	}
+
+	if ambiguous > 0 {
+		logger.Warn("Some score variants could not be told apart from others at the same position",
+			"id", score.ID, "ambiguous", ambiguous, "percent", fmt.Sprintf("%.2f", 100*float64(ambiguous)/float64(stored)))
+	}
+
+	return nil
+}
+
+// pgsReference returns the reference assembly of a PGS Catalog genome build
+// (eg. GRCh38 or hg19), or an empty reference if it isn't known.
+func pgsReference(build string) types.Reference {
+	reference, err := names.Reference(build)
+	if err != nil {
+		return ""
+	}
+
+	return reference
+}
+
+// resolveWeightIDs rewrites any retired RSIDs of a batch of PGS weights to
+// their current IDs.
+func resolveWeightIDs(ctx context.Context, st *store.DB, weights []store.PGSWeight) error {
+	var ids []int64
+	for _, weight := range weights {
+		if weight.ID != nil {
+			ids = append(ids, *weight.ID)
+		}
+	}
+
+	resolved, err := st.ResolveRSIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i, weight := range weights {
+		if weight.ID == nil {
+			continue
+		}
+
+		if currentID, ok := resolved[*weight.ID]; ok {
+			weights[i].ID = &currentID
+		}
+	}
+
+	return nil
+}
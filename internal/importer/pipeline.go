@@ -0,0 +1,403 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/brentp/vcfgo"
+)
+
+const (
+	// The (minimum) number of bytes of records handed to a worker at a time.
+	vcfChunkSize = 1 << 20
+	// The maximum number of chunks in flight, per worker.
+	vcfChunksPerWorker = 4
+)
+
+// vcfConverter converts a parsed VCF record, returning false if the record
+// should be skipped, or an error if it is malformed. It will be called
+// concurrently.
+type vcfConverter[T any] func(variant *vcfgo.Variant) (T, bool, error)
+
+// vcfChunk is a block of complete VCF records.
+type vcfChunk struct {
+	seq int
+	// The line number, and offset, of the first record.
+	lineNumber int64
+	offset     int64
+	data       []byte
+}
+
+// vcfResult is the converted records of a chunk.
+type vcfResult[T any] struct {
+	seq     int
+	records []T
+	// The offset of the end of each record.
+	offsets []int64
+}
+
+// vcfPipeline parses, and converts, the records of a VCF using a pool of
+// workers. Records are returned in the order they appear in the file, so the
+// result of an import doesn't depend upon the number of workers.
+type vcfPipeline[T any] struct {
+	Header *vcfgo.Header
+	br     *bufio.Reader
+	// The line number, and offset, of the first record.
+	lineNumber  int64
+	startOffset int64
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	results chan vcfResult[T]
+	// Limits the number of chunks in flight (so memory use is bounded).
+	tokens chan struct{}
+
+	errMu sync.Mutex
+	err   error
+
+	// Converted chunks which have arrived out of order.
+	pending map[int]vcfResult[T]
+	nextSeq int
+	current vcfResult[T]
+	// The offset of the end of the last record returned.
+	offset int64
+}
+
+// newVCFPipeline reads the header of a VCF, records will not be read until
+// the pipeline is started.
+func newVCFPipeline[T any](r io.Reader) (*vcfPipeline[T], error) {
+	br := bufio.NewReaderSize(r, vcfChunkSize)
+
+	header, lineNumber, err := readVCFHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	vcfReader, err := vcfgo.NewReader(bytes.NewReader(header), true)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vcf reader: %w", err)
+	}
+
+	return &vcfPipeline[T]{
+		Header:      vcfReader.Header,
+		br:          br,
+		lineNumber:  lineNumber + 1,
+		startOffset: int64(len(header)),
+		pending:     make(map[int]vcfResult[T]),
+		offset:      int64(len(header)),
+	}, nil
+}
+
+// readVCFHeader reads the header lines of a VCF, and how many there are,
+// leaving the reader at the first record.
+func readVCFHeader(br *bufio.Reader) ([]byte, int64, error) {
+	var header bytes.Buffer
+	var lineNumber int64
+	for {
+		peek, err := br.Peek(1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, fmt.Errorf("could not read vcf header: %w", err)
+		}
+
+		if len(peek) == 0 || peek[0] != '#' {
+			break
+		}
+
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, fmt.Errorf("could not read vcf header: %w", err)
+		}
+
+		header.Write(line)
+		lineNumber++
+	}
+
+	return header.Bytes(), lineNumber, nil
+}
+
+// start starts reading records, converting them with the given number of
+// workers (or one per CPU if not positive). Malformed records are skipped
+// until the error budget is exhausted.
+func (p *vcfPipeline[T]) start(ctx context.Context, workers int, budget *errorBudget, convert vcfConverter[T]) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.results = make(chan vcfResult[T], workers)
+	p.tokens = make(chan struct{}, workers*vcfChunksPerWorker)
+
+	chunks := make(chan vcfChunk, workers)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(chunks)
+
+		if err := p.read(ctx, chunks); err != nil {
+			p.setError(err)
+		}
+	}()
+
+	var workersWg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+
+			p.work(ctx, chunks, budget, convert)
+		}()
+	}
+
+	go func() {
+		workersWg.Wait()
+		budget.finish()
+		close(p.results)
+	}()
+}
+
+// Next returns the next converted record, or false once every record has
+// been read.
+func (p *vcfPipeline[T]) Next() (T, bool, error) {
+	for len(p.current.records) == 0 {
+		if result, ok := p.pending[p.nextSeq]; ok {
+			delete(p.pending, p.nextSeq)
+			p.nextSeq++
+			p.current = result
+
+			// The chunk is no longer in flight.
+			<-p.tokens
+
+			continue
+		}
+
+		result, ok := <-p.results
+		if !ok {
+			var zero T
+			if err := p.error(); err != nil {
+				return zero, false, err
+			}
+
+			if len(p.pending) > 0 {
+				return zero, false, fmt.Errorf("vcf chunk %d was not converted", p.nextSeq)
+			}
+
+			return zero, false, nil
+		}
+
+		p.pending[result.seq] = result
+	}
+
+	record := p.current.records[0]
+	p.offset = p.current.offsets[0]
+	p.current.records = p.current.records[1:]
+	p.current.offsets = p.current.offsets[1:]
+
+	return record, true, nil
+}
+
+// Offset returns the offset, in the input, of the end of the last record
+// returned by Next. Records before this offset that were skipped won't be
+// returned either.
+func (p *vcfPipeline[T]) Offset() int64 {
+	return p.offset
+}
+
+// Close stops the pipeline, and waits for its workers to exit.
+func (p *vcfPipeline[T]) Close() {
+	if p.cancel == nil {
+		return
+	}
+
+	p.cancel()
+
+	for range p.results {
+	}
+
+	p.wg.Wait()
+}
+
+// read splits the VCF into chunks of complete records.
+func (p *vcfPipeline[T]) read(ctx context.Context, chunks chan<- vcfChunk) error {
+	lineNumber := p.lineNumber
+	offset := p.startOffset
+
+	var remainder []byte
+	for seq := 0; ; seq++ {
+		select {
+		case p.tokens <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		buf := make([]byte, max(vcfChunkSize, 2*len(remainder)))
+		n := copy(buf, remainder)
+
+		var eof bool
+		for {
+			m, err := io.ReadFull(p.br, buf[n:])
+			n += m
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+				break
+			} else if err != nil {
+				return fmt.Errorf("could not read vcf records: %w", err)
+			}
+
+			// Make sure the chunk contains at least one complete record.
+			if bytes.IndexByte(buf[:n], '\n') >= 0 {
+				break
+			}
+
+			buf = append(buf, make([]byte, len(buf))...)
+		}
+
+		end := n
+		if !eof {
+			end = bytes.LastIndexByte(buf[:n], '\n') + 1
+		}
+		remainder = bytes.Clone(buf[end:n])
+
+		if end == 0 {
+			<-p.tokens
+			return nil
+		}
+
+		select {
+		case chunks <- vcfChunk{seq: seq, lineNumber: lineNumber, offset: offset, data: buf[:end]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		lineNumber += int64(bytes.Count(buf[:end], []byte{'\n'}))
+		offset += int64(end)
+
+		if eof {
+			return nil
+		}
+	}
+}
+
+// work parses and converts chunks of records.
+func (p *vcfPipeline[T]) work(ctx context.Context, chunks <-chan vcfChunk, budget *errorBudget, convert vcfConverter[T]) {
+	// Each worker needs its own parser, as they accumulate errors.
+	parser, err := vcfgo.NewWithHeader(strings.NewReader(""), p.Header, true)
+	if err != nil {
+		p.setError(fmt.Errorf("could not create vcf parser: %w", err))
+		return
+	}
+
+	for chunk := range chunks {
+		result := vcfResult[T]{seq: chunk.seq}
+
+		data := chunk.data
+		for lineNumber := chunk.lineNumber; len(data) > 0; lineNumber++ {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, data = data[:i], data[i+1:]
+			} else {
+				data = nil
+			}
+
+			end := chunk.offset + int64(len(chunk.data)-len(data))
+
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+
+			budget.read()
+
+			fields := bytes.SplitN(line, []byte{'\t'}, 9)
+
+			record, ok, err := p.convert(parser, lineNumber, fields, convert)
+			if err != nil {
+				if err := budget.malformed(lineNumber, fields, err); err != nil {
+					p.setError(err)
+					p.cancel()
+					return
+				}
+
+				continue
+			}
+
+			if ok {
+				result.records = append(result.records, record)
+				result.offsets = append(result.offsets, end)
+			}
+		}
+
+		select {
+		case p.results <- result:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// convert parses, and converts, the fields of a record.
+func (p *vcfPipeline[T]) convert(parser *vcfgo.Reader, lineNumber int64, fields [][]byte, convert vcfConverter[T]) (record T, ok bool, err error) {
+	if len(fields) < 8 {
+		return record, false, fmt.Errorf("expected at least 8 fields, got %d", len(fields))
+	}
+
+	// vcfgo panics on (some) malformed records.
+	defer func() {
+		if r := recover(); r != nil {
+			parser.Clear()
+			record, ok, err = *new(T), false, fmt.Errorf("could not parse record: %v", r)
+		}
+	}()
+
+	// We never need the samples (if there are any).
+	parser.LineNumber = lineNumber
+	variant := parser.Parse(fields[:8])
+	if err := parser.Error(); err != nil {
+		parser.Clear()
+		return record, false, err
+	}
+
+	return convert(variant)
+}
+
+func (p *vcfPipeline[T]) setError(err error) {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *vcfPipeline[T]) error() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+
+	return p.err
+}
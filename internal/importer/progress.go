@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Progress displays how much of a set of input files has been read, as a
+// single progress bar. A nil *Progress displays nothing.
+type Progress struct {
+	bar   *pb.ProgressBar
+	sizes map[string]int64
+	// The total size of the files that have been completely imported.
+	completed int64
+}
+
+// NewProgress starts displaying the progress of reading the given files.
+func NewProgress(paths []string) (*Progress, error) {
+	p := &Progress{sizes: make(map[string]int64)}
+
+	var total int64
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not get file info: %w", err)
+		}
+
+		p.sizes[path] = fi.Size()
+		total += fi.Size()
+	}
+
+	p.bar = pb.Full.Start64(total)
+	p.bar.Set(pb.Bytes, true)
+
+	return p, nil
+}
+
+// Finish stops displaying progress.
+func (p *Progress) Finish() {
+	if p != nil {
+		p.bar.Finish()
+	}
+}
+
+// start labels the progress bar with the file currently being read.
+func (p *Progress) start(path string) {
+	if p != nil {
+		p.bar.Set("prefix", filepath.Base(path)+" ")
+	}
+}
+
+// add records that n more (compressed) bytes have been read.
+func (p *Progress) add(n int) {
+	if p != nil {
+		p.bar.Add(n)
+	}
+}
+
+// proxy returns a reader that records the bytes read from r.
+func (p *Progress) proxy(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return p.bar.NewProxyReader(r)
+}
+
+// done records that the given files have been imported (even if they weren't
+// read to the end, eg. due to regions or errors).
+func (p *Progress) done(paths ...string) {
+	if p == nil {
+		return
+	}
+
+	for _, path := range paths {
+		p.completed += p.sizes[path]
+	}
+
+	p.bar.SetCurrent(p.completed)
+}
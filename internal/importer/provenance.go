@@ -0,0 +1,400 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// Version returns the version of the importer, as recorded in its build
+// information.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	// Built from a checkout.
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+
+	if revision == "" {
+		return "devel"
+	}
+
+	version := "devel-" + revision[:min(len(revision), 12)]
+	if modified == "true" {
+		version += "-dirty"
+	}
+
+	return version
+}
+
+// errChecksumMismatch is returned when a file doesn't match its expected
+// checksum.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// fileProvenance is the provenance of a file being imported.
+type fileProvenance struct {
+	store.Provenance
+	path     string
+	expected *Checksum
+
+	mu         sync.Mutex
+	sha256Hash hash.Hash
+	verifyHash hash.Hash
+	w          io.Writer
+	// The length of the start of the file that has been hashed so far.
+	hashed int64
+}
+
+// startProvenance starts recording the provenance of a file. Unless it is
+// verified up front, the file is hashed as its import reads it (see
+// hashInput), and only the parts it doesn't read are read again.
+func startProvenance(ctx context.Context, importName string, options map[string]string, path string, expected *Checksum) (*fileProvenance, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not get file info: %w", err)
+	}
+
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode options: %w", err)
+	}
+
+	p := &fileProvenance{
+		Provenance: store.Provenance{
+			Import:          importName,
+			FileName:        filepath.Base(path),
+			Size:            fi.Size(),
+			Options:         string(encodedOptions),
+			ImporterVersion: Version(),
+			StartedAt:       time.Now().UTC(),
+		},
+		path:       path,
+		expected:   expected,
+		sha256Hash: sha256.New(),
+	}
+
+	p.w = p.sha256Hash
+	p.verifyHash = p.sha256Hash
+	if expected != nil && expected.Algorithm == "md5" {
+		p.verifyHash = md5.New()
+		p.w = io.MultiWriter(p.sha256Hash, p.verifyHash)
+	}
+
+	// Unreadable files will fail to import, so this isn't an error yet.
+	p.FileDate, p.Source, p.Reference, _ = vcfHeaderMetadata(ctx, path)
+
+	return p, nil
+}
+
+// verify hashes the whole file before it is imported, returning an error
+// (errChecksumMismatch) if it doesn't match its expected checksum, so that a
+// truncated or corrupt file is never partially imported.
+func (p *fileProvenance) verify(ctx context.Context) error {
+	if p.expected == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := hashFile(ctx, p.path, 0, p.w); err != nil {
+		// Leave wait to hash the file from its start.
+		p.sha256Hash.Reset()
+		p.verifyHash.Reset()
+
+		return fmt.Errorf("could not verify %s: %w", p.path, err)
+	}
+
+	p.hashed = p.Size
+	p.SHA256 = hex.EncodeToString(p.sha256Hash.Sum(nil))
+
+	if digest := hex.EncodeToString(p.verifyHash.Sum(nil)); digest != p.expected.Digest {
+		return fmt.Errorf("%w: %s checksum of %s is %s, expected %s (is the file truncated?)", errChecksumMismatch, p.expected.Algorithm, p.path, digest, p.expected.Digest)
+	}
+
+	return nil
+}
+
+// hashAt hashes the bytes read from the given offset of the file, if they
+// continue the part of the file hashed so far.
+func (p *fileProvenance) hashAt(offset int64, b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset > p.hashed || offset+int64(len(b)) <= p.hashed {
+		return
+	}
+
+	b = b[p.hashed-offset:]
+	_, _ = p.w.Write(b)
+	p.hashed += int64(len(b))
+}
+
+// wait finishes hashing the file once its import has finished, reading the
+// rest of it if the import didn't (eg. regions, or when resuming). An
+// interrupted import leaves the hash empty.
+func (p *fileProvenance) wait(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hashed < p.Size {
+		if err := hashFile(ctx, p.path, p.hashed, p.w); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("could not hash %s: %w", p.path, err)
+		}
+
+		p.hashed = p.Size
+	}
+
+	if p.SHA256 == "" {
+		p.SHA256 = hex.EncodeToString(p.sha256Hash.Sum(nil))
+	}
+
+	return nil
+}
+
+// finish stores the provenance of the file, once its import has finished.
+func (p *fileProvenance) finish(ctx context.Context, st *store.DB, status string, stats *importStats) error {
+	p.FinishedAt = time.Now().UTC()
+	p.Status = status
+
+	if stats != nil {
+		encodedStats, err := json.Marshal(stats)
+		if err != nil {
+			return fmt.Errorf("could not encode stats: %w", err)
+		}
+
+		p.Stats = string(encodedStats)
+	}
+
+	// Record interrupted imports too.
+	return st.StoreProvenance(context.WithoutCancel(ctx), &p.Provenance)
+}
+
+type provenanceKey struct{}
+
+// withProvenance returns a context under which the given files are hashed as
+// they are read (see hashInput).
+func withProvenance(ctx context.Context, provenance []*fileProvenance) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, provenance)
+}
+
+// hashInput returns a reader of the file at path (read from its start) which
+// also hashes it, if its provenance is being recorded.
+func hashInput(ctx context.Context, path string, r io.Reader) io.Reader {
+	provenance, _ := ctx.Value(provenanceKey{}).([]*fileProvenance)
+	for _, p := range provenance {
+		if p.path == path {
+			return &hashingReader{r: r, p: p}
+		}
+	}
+
+	return r
+}
+
+// hashingReader hashes the bytes read from a file.
+type hashingReader struct {
+	r      io.Reader
+	p      *fileProvenance
+	offset int64
+}
+
+func (hr *hashingReader) Read(b []byte) (int, error) {
+	n, err := hr.r.Read(b)
+	hr.p.hashAt(hr.offset, b[:n])
+	hr.offset += int64(n)
+
+	return n, err
+}
+
+// hashFile writes the contents of a file, from the given offset, to the
+// given hash.
+func hashFile(ctx context.Context, path string, offset int64, h io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := f.Read(buf)
+		_, _ = h.Write(buf[:n])
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// vcfHeaderMetadata returns the file date, source and reference recorded in
+// the header of a VCF (or empty strings if the file isn't a VCF).
+func vcfHeaderMetadata(ctx context.Context, path string) (fileDate, source, reference string, err error) {
+	in, err := openInput(ctx, path, nil)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer in.Close()
+
+	header, _, err := readVCFHeader(bufio.NewReader(in))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if !bytes.HasPrefix(header, []byte("##fileformat=VCF")) {
+		return "", "", "", nil
+	}
+
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "##"), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "fileDate":
+			fileDate = value
+		case "source":
+			source = value
+		case "reference":
+			reference = value
+		}
+	}
+
+	return fileDate, source, reference, nil
+}
+
+// WriteProvenance writes the provenance of every file imported into the
+// database.
+func WriteProvenance(ctx context.Context, st *store.DB, w io.Writer) error {
+	provenance, err := st.Provenance(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(provenance) == 0 {
+		_, err := fmt.Fprintln(w, "No imports recorded")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, p := range provenance {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		var options map[string]string
+		if err := json.Unmarshal([]byte(p.Options), &options); err != nil {
+			return fmt.Errorf("could not decode options of import %d: %w", p.ID, err)
+		}
+
+		keys := make([]string, 0, len(options))
+		for key := range options {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		var formattedOptions []string
+		for _, key := range keys {
+			formattedOptions = append(formattedOptions, key+"="+options[key])
+		}
+
+		fmt.Fprintf(tw, "Import %d:\t%s (%s)\n", p.ID, p.Import, p.Status)
+		fmt.Fprintf(tw, "  File:\t%s (%d bytes)\n", p.FileName, p.Size)
+		if p.SHA256 != "" {
+			fmt.Fprintf(tw, "  SHA-256:\t%s\n", p.SHA256)
+		} else {
+			fmt.Fprintln(tw, "  SHA-256:\tnot computed (the import was interrupted)")
+		}
+		fmt.Fprintf(tw, "  File date:\t%s\n", p.FileDate)
+		fmt.Fprintf(tw, "  Source:\t%s\n", p.Source)
+		fmt.Fprintf(tw, "  Reference:\t%s\n", p.Reference)
+		fmt.Fprintf(tw, "  Options:\t%s\n", strings.Join(formattedOptions, " "))
+		fmt.Fprintf(tw, "  Importer version:\t%s\n", p.ImporterVersion)
+		fmt.Fprintf(tw, "  Started:\t%s (took %s)\n", p.StartedAt.Format(time.RFC3339), p.FinishedAt.Sub(p.StartedAt).Round(time.Second))
+
+		if p.Stats != "" {
+			var stats importStats
+			if err := json.Unmarshal([]byte(p.Stats), &stats); err != nil {
+				return fmt.Errorf("could not decode stats of import %d: %w", p.ID, err)
+			}
+
+			fmt.Fprintf(tw, "  Records:\tread %d, stored %s\n", stats.Read, strings.TrimSpace(fmt.Sprintf("%d %s", stats.Stored, stats.StoredUnit)))
+
+			if len(stats.Skipped) > 0 {
+				fmt.Fprintf(tw, "  Skipped records:\t%s\n", formatCounts(stats.Skipped))
+				fmt.Fprintf(tw, "  Skipped records by chromosome:\t%s\n", formatCounts(stats.SkippedByChromosome))
+			}
+
+			if len(stats.SkippedAlleles) > 0 {
+				fmt.Fprintf(tw, "  Skipped alleles:\t%s\n", formatCounts(stats.SkippedAlleles))
+				fmt.Fprintf(tw, "  Skipped alleles by chromosome:\t%s\n", formatCounts(stats.SkippedAllelesByChromosome))
+			}
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,401 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/zymatik-com/importer/internal/fetch"
+	"github.com/zymatik-com/importer/internal/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Recipe describes how to build a Genobase DB, as a sequence of imports which
+// are run in order, eg.
+//
+//	steps:
+//	  - import: chain-file
+//	    files: [hg19ToHg38.over.chain.gz]
+//	    options:
+//	      from: GRCh37
+//	  - import: alleles
+//	    files: [gnomad.exomes.*.vcf.bgz, gnomad.genomes.*.vcf.bgz]
+//	  - import: variants
+//	    files: [GCF_000001405.40.gz]
+//	    options:
+//	      known: true
+type Recipe struct {
+	Steps []*RecipeStep `yaml:"steps"`
+}
+
+// RecipeStep is a single import of a recipe.
+type RecipeStep struct {
+	// Name identifies the step (defaults to its import).
+	Name string `yaml:"name"`
+	// Import is the import command to run (eg. variants).
+	Import string `yaml:"import"`
+	// Files are the paths, or glob patterns, of the files to import (relative
+	// to the recipe), or their URLs.
+	Files []string `yaml:"files"`
+	// Options are the options of the import command, by flag name. Lists are
+	// passed as repeated flags.
+	Options map[string]any `yaml:"options"`
+	// After names any other steps that must run before this one (besides
+	// those implied by its import).
+	After []string `yaml:"after"`
+
+	// Paths are the files matched by Files (and any URLs, until they are
+	// downloaded).
+	Paths []string `yaml:"-"`
+	// Indices of the earlier steps this step depends on.
+	dependencies []int
+}
+
+// ReadRecipe reads a recipe, checking that all of its files exist and that
+// every step comes after the steps it depends on.
+func ReadRecipe(path string) (*Recipe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open recipe: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	var recipe Recipe
+	if err := dec.Decode(&recipe); err != nil {
+		return nil, fmt.Errorf("could not parse recipe: %w", err)
+	}
+
+	if len(recipe.Steps) == 0 {
+		return nil, fmt.Errorf("recipe has no steps")
+	}
+
+	dir := filepath.Dir(path)
+	for i, step := range recipe.Steps {
+		if step.Import == "" {
+			return nil, fmt.Errorf("step %d has no import", i+1)
+		}
+
+		if step.Name == "" {
+			step.Name = step.Import
+		}
+
+		if len(step.Files) == 0 {
+			return nil, fmt.Errorf("step %s has no files", step.Name)
+		}
+
+		for _, pattern := range step.Files {
+			// URLs are downloaded when the recipe is built.
+			if fetch.IsURL(pattern) {
+				step.Paths = append(step.Paths, pattern)
+				continue
+			}
+
+			// So the recipe builds the same DB wherever it is run from.
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+
+			paths, err := ExpandPaths([]string{pattern})
+			if err != nil {
+				return nil, fmt.Errorf("step %s: %w", step.Name, err)
+			}
+
+			step.Paths = append(step.Paths, paths...)
+		}
+	}
+
+	if err := recipe.resolveDependencies(); err != nil {
+		return nil, err
+	}
+
+	return &recipe, nil
+}
+
+// resolveDependencies finds the steps each step depends on, making sure they
+// come before it.
+func (r *Recipe) resolveDependencies() error {
+	steps := make(map[string]int)
+	for i, step := range r.Steps {
+		if _, ok := steps[step.Name]; ok {
+			return fmt.Errorf("duplicate step name %s (steps with the same import need names)", step.Name)
+		}
+
+		steps[step.Name] = i
+	}
+
+	// earlier returns the steps before i with the given import.
+	earlier := func(i int, importName string) []int {
+		var indices []int
+		for j, step := range r.Steps[:i] {
+			if step.Import == importName {
+				indices = append(indices, j)
+			}
+		}
+
+		return indices
+	}
+
+	// later returns the first step after i with the given import.
+	later := func(i int, importName string) (*RecipeStep, bool) {
+		for _, step := range r.Steps[i+1:] {
+			if step.Import == importName {
+				return step, true
+			}
+		}
+
+		return nil, false
+	}
+
+	for i, step := range r.Steps {
+		for _, name := range step.After {
+			j, ok := steps[name]
+			if !ok {
+				return fmt.Errorf("step %s comes after unknown step %s", step.Name, name)
+			}
+
+			if j >= i {
+				return fmt.Errorf("step %s must come after step %s", step.Name, name)
+			}
+
+			step.dependencies = append(step.dependencies, j)
+		}
+
+		switch step.Import {
+		case "variants":
+			if step.enabled("known") {
+				alleles := earlier(i, "alleles")
+				if len(alleles) == 0 {
+					return fmt.Errorf("step %s imports known variants, so must come after an alleles step", step.Name)
+				}
+
+				// Known alleles are resolved using the merge history.
+				if merged, ok := later(i, "merged-rsids"); ok {
+					return fmt.Errorf("step %s imports known variants, so must come after step %s", step.Name, merged.Name)
+				}
+
+				step.dependencies = append(step.dependencies, alleles...)
+				step.dependencies = append(step.dependencies, earlier(i, "merged-rsids")...)
+			}
+		case "alleles":
+			if step.enabled("joint") {
+				alleles := earlier(i, "alleles")
+				if len(alleles) == 0 {
+					return fmt.Errorf("step %s combines frequencies with another gnomAD dataset, so must come after an alleles step", step.Name)
+				}
+
+				step.dependencies = append(step.dependencies, alleles...)
+			}
+		case "pgs":
+			// Scores are linked against the imported variants.
+			variants := earlier(i, "variants")
+			if len(variants) == 0 {
+				if variantsStep, ok := later(i, "variants"); ok {
+					return fmt.Errorf("step %s must come after step %s", step.Name, variantsStep.Name)
+				}
+			}
+
+			step.dependencies = append(step.dependencies, variants...)
+		}
+
+		slices.Sort(step.dependencies)
+		step.dependencies = slices.Compact(step.dependencies)
+	}
+
+	return nil
+}
+
+// enabled returns whether a boolean option of a step is set.
+func (s *RecipeStep) enabled(name string) bool {
+	values := s.optionValues(name)
+	return len(values) == 1 && values[0] == "true"
+}
+
+// optionValues returns the values of an option of a step.
+func (s *RecipeStep) optionValues(name string) []string {
+	value, ok := s.Options[name]
+	if !ok {
+		return nil
+	}
+
+	if list, ok := value.([]any); ok {
+		values := make([]string, len(list))
+		for i, v := range list {
+			values[i] = fmt.Sprint(v)
+		}
+
+		return values
+	}
+
+	return []string{fmt.Sprint(value)}
+}
+
+// Flags returns the command line flags of the options of a step, in name
+// order.
+func (s *RecipeStep) Flags() []string {
+	var names []string
+	for name := range s.Options {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var flags []string
+	for _, name := range names {
+		for _, value := range s.optionValues(name) {
+			flags = append(flags, "--"+name+"="+value)
+		}
+	}
+
+	return flags
+}
+
+// BuildOptions are the options for building a Genobase DB from a recipe.
+type BuildOptions struct {
+	// Force runs every step, even those whose files haven't changed since
+	// they were last imported.
+	Force bool
+	// Options returns the options of a step's import as recorded in its
+	// provenance, ignoring any that don't change what is imported.
+	Options func(step *RecipeStep) (map[string]string, error)
+}
+
+// Build runs each step of a recipe in turn. Steps whose files have already
+// been imported, with the same options, are skipped unless a step they depend
+// on was run.
+func Build(ctx context.Context, logger *slog.Logger, st *store.DB, recipe *Recipe, opts BuildOptions, run func(ctx context.Context, step *RecipeStep) error) error {
+	// Check the options of every step before running any.
+	options := make([]map[string]string, len(recipe.Steps))
+	for i, step := range recipe.Steps {
+		var err error
+		options[i], err = opts.Options(step)
+		if err != nil {
+			return fmt.Errorf("invalid options for step %s: %w", step.Name, err)
+		}
+	}
+
+	ran := make([]bool, len(recipe.Steps))
+	for i, step := range recipe.Steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		changed := opts.Force
+		for _, j := range step.dependencies {
+			if ran[j] {
+				logger.Info("Running step as a step it depends on was run", "step", step.Name, "dependency", recipe.Steps[j].Name)
+
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			var err error
+			changed, err = stepChanged(ctx, logger, st, step, options[i])
+			if err != nil {
+				return fmt.Errorf("could not check step %s: %w", step.Name, err)
+			}
+		}
+
+		if !changed {
+			logger.Info("Skipping unchanged step", "step", step.Name)
+			continue
+		}
+
+		logger.Info("Running step", "step", step.Name, "import", step.Import, "paths", step.Paths)
+
+		if err := run(ctx, step); err != nil {
+			return fmt.Errorf("step %s failed: %w", step.Name, err)
+		}
+
+		ran[i] = true
+	}
+
+	return nil
+}
+
+// stepChanged returns whether any of the files of a step have changed (or
+// been imported with different options) since they were last imported.
+func stepChanged(ctx context.Context, logger *slog.Logger, st *store.DB, step *RecipeStep, options map[string]string) (bool, error) {
+	provenance, err := st.Provenance(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, path := range step.Paths {
+		// The most recent import of the file.
+		var last *store.Provenance
+		for i := len(provenance) - 1; i >= 0; i-- {
+			if provenance[i].Import == step.Import && provenance[i].FileName == filepath.Base(path) {
+				last = &provenance[i]
+				break
+			}
+		}
+
+		if last == nil || last.Status != "imported" {
+			return true, nil
+		}
+
+		var lastOptions map[string]string
+		if err := json.Unmarshal([]byte(last.Options), &lastOptions); err != nil {
+			return false, fmt.Errorf("could not decode options of import %d: %w", last.ID, err)
+		}
+
+		for name, value := range options {
+			if lastOptions[name] != value {
+				logger.Info("Options have changed since the last import", "step", step.Name, "option", name, "value", value, "previous", lastOptions[name])
+
+				return true, nil
+			}
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("could not get file info: %w", err)
+		}
+
+		if fi.Size() != last.Size {
+			return true, nil
+		}
+
+		logger.Debug("Checking whether file has changed", "path", path)
+
+		h := sha256.New()
+		if err := hashFile(ctx, path, 0, h); err != nil {
+			return false, fmt.Errorf("could not hash file: %w", err)
+		}
+
+		if hex.EncodeToString(h.Sum(nil)) != last.SHA256 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
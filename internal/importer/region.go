@@ -0,0 +1,445 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zymatik-com/importer/internal/bgzf"
+	"github.com/zymatik-com/importer/internal/tabix"
+)
+
+// Region is a 1-based, inclusive range of positions on a contig, an end of
+// zero means the end of the contig.
+type Region struct {
+	Contig string
+	Start  uint64
+	End    uint64
+}
+
+func (r Region) String() string {
+	if r.End == 0 {
+		return fmt.Sprintf("%s:%d", r.Contig, r.Start)
+	}
+
+	return fmt.Sprintf("%s:%d-%d", r.Contig, r.Start, r.End)
+}
+
+// overlaps reports whether a record at pos, spanning refLength bases,
+// overlaps the region.
+func (r Region) overlaps(pos uint64, refLength int) bool {
+	if r.End != 0 && pos > r.End {
+		return false
+	}
+
+	return pos+uint64(max(refLength, 1))-1 >= r.Start
+}
+
+// ParseRegion parses a samtools style region, eg. chr1, chr1:1000 or
+// chr1:1,000-2,000.
+func ParseRegion(s string) (Region, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		if s == "" {
+			return Region{}, errors.New("empty region")
+		}
+
+		return Region{Contig: s, Start: 1}, nil
+	}
+
+	region := Region{Contig: s[:i]}
+
+	start, end, hasEnd := strings.Cut(strings.ReplaceAll(s[i+1:], ",", ""), "-")
+
+	var err error
+	region.Start, err = strconv.ParseUint(start, 10, 64)
+	if err != nil {
+		return Region{}, fmt.Errorf("could not parse region start %q: %w", s, err)
+	}
+
+	if hasEnd {
+		region.End, err = strconv.ParseUint(end, 10, 64)
+		if err != nil {
+			return Region{}, fmt.Errorf("could not parse region end %q: %w", s, err)
+		}
+	}
+
+	if err := region.validate(); err != nil {
+		return Region{}, err
+	}
+
+	return region, nil
+}
+
+// ReadRegionsFile reads the regions in a BED file (BED coordinates are
+// 0-based and half open).
+func ReadRegionsFile(path string) ([]Region, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open regions file: %w", err)
+	}
+	defer f.Close()
+
+	var regions []Region
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("expected at least 3 fields on line %d of regions file", lineNumber)
+		}
+
+		start, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse start on line %d of regions file: %w", lineNumber, err)
+		}
+
+		end, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse end on line %d of regions file: %w", lineNumber, err)
+		}
+
+		region := Region{Contig: fields[0], Start: start + 1, End: end}
+		if err := region.validate(); err != nil {
+			return nil, fmt.Errorf("invalid region on line %d of regions file: %w", lineNumber, err)
+		}
+
+		regions = append(regions, region)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read regions file: %w", err)
+	}
+
+	return regions, nil
+}
+
+func (r Region) validate() error {
+	if r.Contig == "" {
+		return errors.New("region has no contig")
+	}
+
+	if r.Start == 0 {
+		return fmt.Errorf("region %s starts before position 1", r)
+	}
+
+	if r.End != 0 && r.End < r.Start {
+		return fmt.Errorf("region %s ends before it starts", r)
+	}
+
+	return nil
+}
+
+// openVCF opens a (possibly compressed) VCF, restricted to records overlapping
+// the given regions (if any). When a tabix or CSI index sits next to the VCF
+// only the indexed regions are read, otherwise the whole file is filtered.
+// Contig names are compared after mapping them with contigName.
+func openVCF(ctx context.Context, logger *slog.Logger, path string, regions []Region, contigName func(string) string, progress *Progress) (*input, error) {
+	if len(regions) == 0 {
+		return openInput(ctx, path, progress)
+	}
+
+	for _, ext := range []string{".tbi", ".csi"} {
+		idx, err := tabix.Open(path + ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read index %q: %w", path+ext, err)
+		}
+
+		return openIndexedRegions(logger, path, idx, regions, contigName, progress)
+	}
+
+	logger.Warn("No tabix or CSI index found, filtering the whole file", "path", path)
+
+	in, err := openInput(ctx, path, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	contigs := make(map[string][]Region)
+	for _, region := range regions {
+		name := contigName(region.Contig)
+		contigs[name] = append(contigs[name], region)
+	}
+
+	in.filter(func(w io.Writer) error {
+		return copyLines(w, in.dr, true, func(contig string, pos uint64, refLength int) (bool, bool) {
+			return slices.ContainsFunc(contigs[contigName(contig)], func(region Region) bool {
+				return region.overlaps(pos, refLength)
+			}), false
+		})
+	})
+
+	return in, nil
+}
+
+// indexedRegion is a region resolved against an index.
+type indexedRegion struct {
+	Region
+	tid int
+	// The start of the first chunk of the file that may hold records in the
+	// region.
+	begin bgzf.VirtualOffset
+}
+
+// openIndexedRegions seeks to each of the regions of a BGZF compressed VCF,
+// using its index. Regions are read in the order of the file (merging any
+// that overlap).
+func openIndexedRegions(logger *slog.Logger, path string, idx *tabix.Index, regions []Region, contigName func(string) string, progress *Progress) (*input, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &input{f: f}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not get file info: %w", err)
+	}
+
+	var header bytes.Buffer
+	if err := readBGZFHeader(&header, f, fi.Size()); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not read vcf header: %w", err)
+	}
+
+	// bcftools CSI indexes don't record sequence names, they are in the order
+	// of the header contigs instead.
+	contigs := idx.Names
+	if len(contigs) == 0 {
+		contigs = headerContigs(header.Bytes())
+	}
+
+	resolved := resolveRegions(logger, idx, contigs, regions, contigName)
+
+	progress.start(path)
+
+	in.filter(func(w io.Writer) error {
+		if _, err := header.WriteTo(w); err != nil {
+			return err
+		}
+
+		for _, region := range resolved {
+			if err := in.copyRegion(w, region, fi.Size(), progress); err != nil {
+				return fmt.Errorf("could not read region %s: %w", region.Region, err)
+			}
+		}
+
+		return nil
+	})
+
+	return in, nil
+}
+
+// resolveRegions finds the index chunks for each region, in file order.
+func resolveRegions(logger *slog.Logger, idx *tabix.Index, contigs []string, regions []Region, contigName func(string) string) []indexedRegion {
+	var resolved []indexedRegion
+	for _, region := range regions {
+		tid := slices.IndexFunc(contigs, func(contig string) bool {
+			return contig == region.Contig || contigName(contig) == contigName(region.Contig)
+		})
+		if tid < 0 {
+			logger.Warn("Skipping region on contig not in index", "region", region)
+			continue
+		}
+
+		region.Contig = contigs[tid]
+		resolved = append(resolved, indexedRegion{Region: region, tid: tid})
+	}
+
+	slices.SortFunc(resolved, func(a, b indexedRegion) int {
+		if c := cmp.Compare(a.tid, b.tid); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	// Merge overlapping regions so records aren't read twice.
+	var merged []indexedRegion
+	for _, region := range resolved {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.tid == region.tid && (last.End == 0 || region.Start <= last.End+1) {
+				if last.End != 0 && (region.End == 0 || region.End > last.End) {
+					last.End = region.End
+				}
+				continue
+			}
+		}
+
+		merged = append(merged, region)
+	}
+
+	resolved = merged[:0]
+	for _, region := range merged {
+		chunks := idx.Chunks(region.tid, region.Start, region.End)
+		if len(chunks) == 0 {
+			// No records in the region.
+			continue
+		}
+
+		region.begin = chunks[0].Begin
+		for _, chunk := range chunks[1:] {
+			region.begin = min(region.begin, chunk.Begin)
+		}
+
+		resolved = append(resolved, region)
+	}
+
+	return resolved
+}
+
+// copyRegion copies the records of a region, starting from the first chunk
+// that may hold records in the region until a record past the region is read.
+func (in *input) copyRegion(w io.Writer, region indexedRegion, size int64, progress *Progress) error {
+	sr := io.NewSectionReader(in.f, region.begin.Block(), size-region.begin.Block())
+
+	r := bgzf.NewReader(bufio.NewReaderSize(sr, bgzf.MaxBlockSize), runtime.NumCPU())
+	defer r.Close()
+
+	r.Progress = progress.add
+
+	if _, err := io.CopyN(io.Discard, r, int64(region.begin.Offset())); err != nil {
+		return err
+	}
+
+	return copyLines(w, r, false, func(contig string, pos uint64, refLength int) (bool, bool) {
+		// Records are sorted, so we're done once we've passed the region.
+		if contig != region.Contig || (region.End != 0 && pos > region.End) {
+			return false, true
+		}
+
+		return region.overlaps(pos, refLength), false
+	})
+}
+
+// readBGZFHeader reads the header lines from the start of a BGZF
+// compressed VCF.
+func readBGZFHeader(w io.Writer, f *os.File, size int64) error {
+	r := bgzf.NewReader(bufio.NewReaderSize(io.NewSectionReader(f, 0, size), bgzf.MaxBlockSize), 1)
+	defer r.Close()
+
+	return copyLines(w, r, true, func(string, uint64, int) (bool, bool) {
+		return false, true
+	})
+}
+
+var contigIDPattern = regexp.MustCompile(`^##contig=<ID=([^,>]+)`)
+
+// headerContigs returns the contig IDs of a VCF header, in order.
+func headerContigs(header []byte) []string {
+	var contigs []string
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		if m := contigIDPattern.FindSubmatch(line); m != nil {
+			contigs = append(contigs, string(m[1]))
+		}
+	}
+
+	return contigs
+}
+
+// filter replaces the input with the output of a function, run in a
+// separate goroutine.
+func (in *input) filter(fn func(w io.Writer) error) {
+	pr, pw := io.Pipe()
+	in.Reader, in.pipe = pr, pr
+
+	in.wg.Add(1)
+	go func() {
+		defer in.wg.Done()
+
+		_ = pw.CloseWithError(fn(pw))
+	}()
+}
+
+// copyLines copies the lines of a VCF from r to w. Header lines are copied if
+// header is set, and records if keep reports they should be. Copying stops
+// early once keep reports it is done. Malformed records are always copied
+// (so they are reported when parsed).
+func copyLines(w io.Writer, r io.Reader, header bool, keep func(contig string, pos uint64, refLength int) (ok, done bool)) error {
+	br := bufio.NewReaderSize(r, vcfChunkSize)
+	bw := bufio.NewWriterSize(w, vcfChunkSize)
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			long := slices.Clone(line)
+			for errors.Is(err, bufio.ErrBufferFull) {
+				line, err = br.ReadSlice('\n')
+				long = append(long, line...)
+			}
+			line = long
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if len(line) > 0 {
+			ok, done := true, false
+			if line[0] == '#' {
+				ok = header
+			} else if fields := bytes.SplitN(line, []byte("\t"), 5); len(fields) == 5 {
+				if pos, parseErr := strconv.ParseUint(string(fields[1]), 10, 64); parseErr == nil {
+					ok, done = keep(string(fields[0]), pos, len(fields[3]))
+				}
+			}
+
+			if done {
+				break
+			}
+
+			if ok {
+				if _, err := bw.Write(line); err != nil {
+					return err
+				}
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	return bw.Flush()
+}
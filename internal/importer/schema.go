@@ -0,0 +1,250 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/brentp/vcfgo"
+	"github.com/zymatik-com/genobase/types"
+	"github.com/zymatik-com/importer/internal/store"
+)
+
+// gnoMAD releases, as far as their INFO field naming is concerned.
+const (
+	gnoMADVersion2      = "v2"
+	gnoMADVersion3      = "v3"
+	gnoMADVersion4      = "v4"
+	gnoMADVersion4Joint = "v4-joint"
+	// gnoMADv3 mitochondrial variants use their own format.
+	gnoMADVersion3MT = "v3-mt"
+	// The INFO fields were supplied by the user.
+	gnoMADVersionCustom = "custom"
+)
+
+// All the ancestry groups Genobase knows about (for parsing mapping files).
+var knownAncestryGroups = []types.AncestryGroup{
+	types.AncestryGroupAll,
+	types.AncestryGroupAfrican,
+	types.AncestryGroupAmish,
+	types.AncestryGroupAmerican,
+	types.AncestryGroupAshkenazi,
+	types.AncestryGroupEastAsian,
+	types.AncestryGroupFinnish,
+	types.AncestryGroupMiddleEastern,
+	types.AncestryGroupEuropean,
+	types.AncestryGroupOther,
+	types.AncestryGroupSouthAsian,
+}
+
+// ancestryKey is the INFO field holding the allele frequency of an ancestry group.
+type ancestryKey struct {
+	ancestry types.AncestryGroup
+	key      string
+}
+
+// gnoMADSchema describes which INFO fields of a gnoMAD VCF hold the allele
+// frequencies of each ancestry group.
+type gnoMADSchema struct {
+	version string
+	// The first key is always the overall (AncestryGroupAll) frequency.
+	frequencyKeys []ancestryKey
+	// Ancestry groups we import which this release doesn't have.
+	absent []types.AncestryGroup
+	// Sex-specific allele frequency fields (only populated when requested).
+	karyotypeKeys []karyotypeKey
+}
+
+// karyotypeKey is the INFO field holding the allele frequency of an ancestry
+// group amongst individuals of a given karyotype.
+type karyotypeKey struct {
+	ancestryKey
+	karyotype store.Karyotype
+}
+
+// The suffixes of sex-specific INFO fields, gnoMADv2 used the terms
+// female/male rather than XX/XY.
+var karyotypeSuffixes = []struct {
+	karyotype store.Karyotype
+	suffixes  []string
+}{
+	{karyotype: store.KaryotypeXX, suffixes: []string{"_XX", "_female"}},
+	{karyotype: store.KaryotypeXY, suffixes: []string{"_XY", "_male"}},
+}
+
+// detectGnoMADSchema works out the gnoMAD release a VCF is from (using the
+// INFO fields declared in its header), and the INFO fields of each ancestry
+// group we import.
+func detectGnoMADSchema(header *vcfgo.Header) (*gnoMADSchema, error) {
+	hasInfo := func(key string) bool {
+		_, ok := header.Infos[key]
+		return ok
+	}
+
+	var version, prefix string
+	switch {
+	case hasInfo("AF_joint"):
+		version, prefix = gnoMADVersion4Joint, "AF_joint"
+	case hasInfo("AF_remaining"):
+		version, prefix = gnoMADVersion4, "AF"
+	case hasInfo("AF_ami") || hasInfo("AF_mid"):
+		version, prefix = gnoMADVersion3, "AF"
+	case hasInfo("AF"):
+		version, prefix = gnoMADVersion2, "AF"
+	case hasInfo("AF_hom") && hasInfo("AF_het"):
+		return &gnoMADSchema{version: gnoMADVersion3MT}, nil
+	default:
+		return nil, fmt.Errorf("could not detect gnoMAD version, no allele frequency fields in header")
+	}
+
+	schema := &gnoMADSchema{
+		version: version,
+		frequencyKeys: []ancestryKey{
+			{ancestry: types.AncestryGroupAll, key: prefix},
+		},
+	}
+
+	for _, ancestry := range ancestryGroups {
+		if ancestry == types.AncestryGroupAll {
+			continue
+		}
+
+		key := fmt.Sprintf("%s_%s", prefix, strings.ToLower(string(ancestry)))
+
+		// Not every release has every ancestry group (eg. v4 exomes have no Amish).
+		if !hasInfo(key) {
+			schema.absent = append(schema.absent, ancestry)
+			continue
+		}
+
+		schema.frequencyKeys = append(schema.frequencyKeys, ancestryKey{ancestry: ancestry, key: key})
+	}
+
+	return schema, nil
+}
+
+// readGnoMADSchema reads a user supplied mapping from INFO fields to ancestry
+// groups. Each line is an INFO field and an ancestry group separated by
+// whitespace (eg. "AF_joint_nfe nfe"), lines starting with '#' are ignored.
+func readGnoMADSchema(path string) (*gnoMADSchema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open ancestry mapping file: %w", err)
+	}
+	defer f.Close()
+
+	schema := &gnoMADSchema{version: gnoMADVersionCustom}
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid ancestry mapping on line %d: %q", lineNumber, line)
+		}
+
+		ancestry, err := parseAncestryGroup(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ancestry mapping on line %d: %w", lineNumber, err)
+		}
+
+		schema.frequencyKeys = append(schema.frequencyKeys, ancestryKey{ancestry: ancestry, key: fields[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read ancestry mapping file: %w", err)
+	}
+
+	// Make sure the overall frequency comes first.
+	sort.SliceStable(schema.frequencyKeys, func(i, j int) bool {
+		return schema.frequencyKeys[i].ancestry == types.AncestryGroupAll &&
+			schema.frequencyKeys[j].ancestry != types.AncestryGroupAll
+	})
+
+	if len(schema.frequencyKeys) == 0 || schema.frequencyKeys[0].ancestry != types.AncestryGroupAll {
+		return nil, fmt.Errorf("ancestry mapping file must map the %s ancestry group", types.AncestryGroupAll)
+	}
+
+	return schema, nil
+}
+
+// validate makes sure every INFO field the schema refers to is declared in
+// the VCF header.
+func (s *gnoMADSchema) validate(header *vcfgo.Header) error {
+	var missing []string
+	for _, ak := range s.frequencyKeys {
+		if _, ok := header.Infos[ak.key]; !ok {
+			missing = append(missing, fmt.Sprintf("%s (%s)", ak.key, ak.ancestry))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("gnoMAD %s ancestry groups missing from VCF header: %s", s.version, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// detectKaryotypeKeys finds the sex-specific INFO fields (eg. AF_nfe_XX)
+// accompanying each of the schema's allele frequency fields.
+func (s *gnoMADSchema) detectKaryotypeKeys(header *vcfgo.Header) {
+	for _, ak := range s.frequencyKeys {
+		for _, ks := range karyotypeSuffixes {
+			for _, suffix := range ks.suffixes {
+				if _, ok := header.Infos[ak.key+suffix]; ok {
+					s.karyotypeKeys = append(s.karyotypeKeys, karyotypeKey{
+						ancestryKey: ancestryKey{ancestry: ak.ancestry, key: ak.key + suffix},
+						karyotype:   ks.karyotype,
+					})
+
+					break
+				}
+			}
+		}
+	}
+}
+
+func parseAncestryGroup(s string) (types.AncestryGroup, error) {
+	for _, ancestry := range knownAncestryGroups {
+		if strings.EqualFold(string(ancestry), s) {
+			return ancestry, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown ancestry group: %s", s)
+}
+
+// countKey returns the INFO field holding the given count (eg. AC or AN) that
+// accompanies an allele frequency field (eg. AF_nfe -> AN_nfe). Returns an
+// empty string if the frequency field doesn't follow the gnoMAD naming.
+func countKey(frequencyKey, count string) string {
+	if frequencyKey != "AF" && !strings.HasPrefix(frequencyKey, "AF_") {
+		return ""
+	}
+
+	return count + strings.TrimPrefix(frequencyKey, "AF")
+}
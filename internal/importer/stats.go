@@ -0,0 +1,319 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package importer
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brentp/vcfgo"
+)
+
+// Reasons for skipping records.
+const (
+	skipMalformed         = "malformed record"
+	skipMultiNucleotide   = "multi-nucleotide variant"
+	skipNotCommon         = "not common"
+	skipNotKnown          = "no allele frequencies"
+	skipUnknownContig     = "unknown contig"
+	skipNormalize         = "could not normalize"
+	skipReferenceMismatch = "reference mismatch"
+	skipPseudoAutosomal   = "pseudo-autosomal copy"
+	skipFiltered          = "failed filters"
+	skipNoRSID            = "no rsID"
+	skipUnsupportedClass  = "unsupported variant class"
+	skipNoFrequency       = "no allele frequency"
+	skipLowFrequency      = "below minimum frequency"
+)
+
+// What an import stores.
+const (
+	unitVariants = "variants"
+	unitAlleles  = "alleles"
+)
+
+// Stats counts the records read by an import, how many variants (or alleles)
+// were stored, and how many records (or alleles of records) were skipped and
+// why. A nil *Stats counts nothing.
+type Stats struct {
+	mu      sync.Mutex
+	counts  importStats
+	rejects *Rejects
+}
+
+// importStats summarizes the records of an import.
+type importStats struct {
+	// Read is the number of records read.
+	Read int64 `json:"read"`
+	// Stored is the number of variants or alleles (see StoredUnit) stored.
+	Stored     int64  `json:"stored"`
+	StoredUnit string `json:"stored_unit,omitempty"`
+	// Skipped is the number of records skipped, by reason.
+	Skipped map[string]int64 `json:"skipped,omitempty"`
+	// SkippedByChromosome is the number of records skipped, by chromosome.
+	SkippedByChromosome map[string]int64 `json:"skipped_by_chromosome,omitempty"`
+	// SkippedAlleles is the number of alleles skipped (from records which
+	// weren't skipped as a whole), by reason.
+	SkippedAlleles map[string]int64 `json:"skipped_alleles,omitempty"`
+	// SkippedAllelesByChromosome is the number of alleles skipped, by
+	// chromosome.
+	SkippedAllelesByChromosome map[string]int64 `json:"skipped_alleles_by_chromosome,omitempty"`
+}
+
+// newStats starts counting the records of an import, writing any skipped
+// records to rejects (if set).
+func newStats(rejects *Rejects) *Stats {
+	return &Stats{
+		counts: importStats{
+			Skipped:                    make(map[string]int64),
+			SkippedByChromosome:        make(map[string]int64),
+			SkippedAlleles:             make(map[string]int64),
+			SkippedAllelesByChromosome: make(map[string]int64),
+		},
+		rejects: rejects,
+	}
+}
+
+// read records that a record was read.
+func (s *Stats) read() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.counts.Read++
+	s.mu.Unlock()
+}
+
+// stored records that n variants or alleles (the unit) were stored.
+func (s *Stats) stored(n int, unit string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.counts.Stored += int64(n)
+	s.counts.StoredUnit = unit
+	s.mu.Unlock()
+}
+
+// skip records that a VCF record was skipped.
+func (s *Stats) skip(variant *vcfgo.Variant, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.skipRecord(variant.Chromosome, variant.Pos, variant.Id(), variant.Ref(), strings.Join(variant.Alt(), ","), reason)
+}
+
+// skipRecord records that a whole record was skipped.
+func (s *Stats) skipRecord(chromosome string, pos uint64, id, reference, alternate, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.counts.Skipped[reason]++
+	s.counts.SkippedByChromosome[chromosome]++
+	s.mu.Unlock()
+
+	s.rejects.write(chromosome, pos, id, reference, alternate, reason)
+}
+
+// skipAllele records that a single allele (of a record) was skipped.
+func (s *Stats) skipAllele(chromosome string, pos uint64, id, reference, alternate, reason string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.counts.SkippedAlleles[reason]++
+	s.counts.SkippedAllelesByChromosome[chromosome]++
+	s.mu.Unlock()
+
+	s.rejects.write(chromosome, pos, id, reference, alternate, reason)
+}
+
+// summary returns a copy of the statistics so far, or nil if nothing was
+// counted.
+func (s *Stats) summary() *importStats {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts.Read == 0 && s.counts.Stored == 0 {
+		return nil
+	}
+
+	summary := s.counts
+	summary.Skipped = cloneCounts(s.counts.Skipped)
+	summary.SkippedByChromosome = cloneCounts(s.counts.SkippedByChromosome)
+	summary.SkippedAlleles = cloneCounts(s.counts.SkippedAlleles)
+	summary.SkippedAllelesByChromosome = cloneCounts(s.counts.SkippedAllelesByChromosome)
+
+	return &summary
+}
+
+// log logs the statistics of an import, labelling each count with its unit.
+func (s *importStats) log(logger *slog.Logger, paths []string) {
+	storedKey := "stored"
+	switch s.StoredUnit {
+	case unitVariants:
+		storedKey = "storedVariants"
+	case unitAlleles:
+		storedKey = "storedAlleles"
+	}
+
+	attrs := []any{"paths", paths, "readRecords", s.Read, storedKey, s.Stored, "skippedRecords", totalCount(s.Skipped)}
+	if len(s.SkippedAlleles) > 0 {
+		attrs = append(attrs, "skippedAlleles", totalCount(s.SkippedAlleles))
+	}
+
+	logger.Info("Import statistics", attrs...)
+
+	for _, count := range sortedCounts(s.Skipped) {
+		logger.Info("Skipped records", "reason", count.key, "count", count.n)
+	}
+
+	for _, count := range sortedCounts(s.SkippedAlleles) {
+		logger.Info("Skipped alleles", "reason", count.key, "count", count.n)
+	}
+
+	for _, count := range sortedCounts(s.SkippedByChromosome) {
+		logger.Debug("Skipped records", "chromosome", count.key, "count", count.n)
+	}
+
+	for _, count := range sortedCounts(s.SkippedAllelesByChromosome) {
+		logger.Debug("Skipped alleles", "chromosome", count.key, "count", count.n)
+	}
+}
+
+// totalCount returns the total of counts.
+func totalCount(counts map[string]int64) int64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+
+	return total
+}
+
+// formatCounts formats counts as a single line, largest first.
+func formatCounts(counts map[string]int64) string {
+	var formatted []string
+	for _, count := range sortedCounts(counts) {
+		formatted = append(formatted, fmt.Sprintf("%s=%d", count.key, count.n))
+	}
+
+	return strings.Join(formatted, ", ")
+}
+
+type count struct {
+	key string
+	n   int64
+}
+
+// sortedCounts returns counts, largest first.
+func sortedCounts(counts map[string]int64) []count {
+	sorted := make([]count, 0, len(counts))
+	for key, n := range counts {
+		sorted = append(sorted, count{key, n})
+	}
+
+	slices.SortFunc(sorted, func(a, b count) int {
+		if c := cmp.Compare(b.n, a.n); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.key, b.key)
+	})
+
+	return sorted
+}
+
+func cloneCounts(counts map[string]int64) map[string]int64 {
+	clone := make(map[string]int64, len(counts))
+	for key, n := range counts {
+		clone[key] = n
+	}
+
+	return clone
+}
+
+// Rejects writes skipped records, and why they were skipped, to a TSV file
+// (so missing variants can be audited). A nil *Rejects writes nothing.
+type Rejects struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// CreateRejects creates a rejects file.
+func CreateRejects(path string) (*Rejects, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create rejects file: %w", err)
+	}
+
+	r := &Rejects{f: f, w: bufio.NewWriter(f)}
+
+	if _, err := r.w.WriteString("#CHROM\tPOS\tID\tREF\tALT\tREASON\n"); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not write rejects file: %w", err)
+	}
+
+	return r, nil
+}
+
+// Close flushes and closes the rejects file.
+func (r *Rejects) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	if err := r.w.Flush(); err != nil {
+		_ = r.f.Close()
+		return fmt.Errorf("could not write rejects file: %w", err)
+	}
+
+	return r.f.Close()
+}
+
+func (r *Rejects) write(chromosome string, pos uint64, id, reference, alternate, reason string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Write errors are reported on Close.
+	_, _ = r.w.WriteString(chromosome + "\t" + strconv.FormatUint(pos, 10) + "\t" + id + "\t" + reference + "\t" + alternate + "\t" + reason + "\n")
+}
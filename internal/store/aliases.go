@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The maximum length of a chain of merges we will follow, guards against
+// cycles in the merge history.
+const maxMergeChainLength = 32
+
+// RSIDAlias maps a retired (merged) dbSNP reference SNP ID to the ID it was
+// merged into.
+type RSIDAlias struct {
+	RetiredID int64 `db:"retired_id"`
+	CurrentID int64 `db:"current_id"`
+}
+
+// StoreRSIDAliases stores (or replaces) a batch of RSID aliases.
+func (db *DB) StoreRSIDAliases(ctx context.Context, aliases []RSIDAlias) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `INSERT OR REPLACE INTO rsid_aliases
+		(retired_id, current_id) VALUES (:retired_id, :current_id)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, alias := range aliases {
+		if alias.RetiredID == alias.CurrentID {
+			continue
+		}
+
+		if _, err := stmt.ExecContext(ctx, alias); err != nil {
+			return fmt.Errorf("could not store rsid alias: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// FlattenRSIDAliases rewrites chains of merges (eg. rs1 -> rs2 -> rs3) so
+// that every retired ID maps directly to its current ID.
+func (db *DB) FlattenRSIDAliases(ctx context.Context) error {
+	for i := 0; i < maxMergeChainLength; i++ {
+		res, err := db.ExecContext(ctx, `UPDATE rsid_aliases
+			SET current_id = (SELECT next.current_id FROM rsid_aliases AS next WHERE next.retired_id = rsid_aliases.current_id)
+			WHERE current_id IN (SELECT retired_id FROM rsid_aliases)`)
+		if err != nil {
+			return fmt.Errorf("could not flatten rsid aliases: %w", err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("could not get affected rows: %w", err)
+		}
+
+		if n == 0 {
+			break
+		}
+	}
+
+	// Drop any cycles we may have collapsed.
+	if _, err := db.ExecContext(ctx, `DELETE FROM rsid_aliases WHERE retired_id = current_id`); err != nil {
+		return fmt.Errorf("could not delete cyclic rsid aliases: %w", err)
+	}
+
+	return nil
+}
+
+// ResolveRSID resolves a (possibly retired) dbSNP reference SNP ID to its
+// current ID. IDs which have not been merged are returned as is.
+func (db *DB) ResolveRSID(ctx context.Context, id int64) (int64, error) {
+	for i := 0; i < maxMergeChainLength; i++ {
+		var currentID int64
+		if err := db.GetContext(ctx, &currentID, `SELECT current_id FROM rsid_aliases WHERE retired_id = ?`, id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return id, nil
+			}
+
+			return 0, fmt.Errorf("could not resolve rsid: %w", err)
+		}
+
+		id = currentID
+	}
+
+	return 0, fmt.Errorf("rsid merge chain too long")
+}
+
+// ResolveRSIDs resolves a batch of dbSNP reference SNP IDs, returning the
+// current ID of any which have been retired. Aliases must be flattened.
+func (db *DB) ResolveRSIDs(ctx context.Context, ids []int64) (map[int64]int64, error) {
+	resolved := make(map[int64]int64)
+
+	for start := 0; start < len(ids); start += maxQueryParameters {
+		end := min(start+maxQueryParameters, len(ids))
+
+		query, args, err := sqlx.In(`SELECT retired_id, current_id FROM rsid_aliases WHERE retired_id IN (?)`, ids[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("could not build query: %w", err)
+		}
+
+		var aliases []RSIDAlias
+		if err := db.SelectContext(ctx, &aliases, db.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("could not query rsid aliases: %w", err)
+		}
+
+		for _, alias := range aliases {
+			resolved[alias.RetiredID] = alias.CurrentID
+		}
+	}
+
+	return resolved, nil
+}
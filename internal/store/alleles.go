@@ -0,0 +1,257 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zymatik-com/genobase/types"
+)
+
+// AlleleSource is the gnoMAD dataset an allele frequency estimate was
+// derived from.
+type AlleleSource string
+
+const (
+	AlleleSourceExome  AlleleSource = "exome"
+	AlleleSourceGenome AlleleSource = "genome"
+	// AlleleSourceJoint estimates combine the exome and genome datasets.
+	AlleleSourceJoint AlleleSource = "joint"
+)
+
+// Karyotype is the sex chromosome karyotype of a group of individuals.
+type Karyotype string
+
+const (
+	KaryotypeXX Karyotype = "XX"
+	KaryotypeXY Karyotype = "XY"
+)
+
+// AlleleEstimate records the provenance of a Genobase allele frequency, along
+// with the counts it was computed from (when known). Each gnoMAD dataset's
+// estimate of an allele is kept alongside any joint estimate computed from
+// them, so the joint estimate can be computed again when either dataset is
+// re-imported.
+type AlleleEstimate struct {
+	ID        int64               `db:"id"`
+	Reference string              `db:"reference"`
+	Alternate string              `db:"alternate"`
+	Ancestry  types.AncestryGroup `db:"ancestry"`
+	Source    AlleleSource        `db:"source"`
+	// AlleleCount is the number of alternate alleles observed (AC).
+	AlleleCount *int64 `db:"allele_count"`
+	// AlleleNumber is the total number of alleles genotyped (AN).
+	AlleleNumber *int64 `db:"allele_number"`
+	// HomozygoteCount is the number of homozygous individuals (nhomalt).
+	HomozygoteCount *int64 `db:"homozygote_count"`
+	// HomoplasmicCount is the number of individuals with a homoplasmic
+	// mitochondrial variant (AC_hom).
+	HomoplasmicCount *int64 `db:"homoplasmic_count"`
+	// HeteroplasmicCount is the number of individuals with a heteroplasmic
+	// mitochondrial variant (AC_het).
+	HeteroplasmicCount *int64 `db:"heteroplasmic_count"`
+}
+
+// StoreAlleleEstimates stores (or replaces) a batch of allele estimates.
+func (db *DB) StoreAlleleEstimates(ctx context.Context, estimates []AlleleEstimate) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `INSERT OR REPLACE INTO allele_estimates
+		(id, reference, alternate, ancestry, source, allele_count, allele_number, homozygote_count, homoplasmic_count, heteroplasmic_count)
+		VALUES (:id, :reference, :alternate, :ancestry, :source, :allele_count, :allele_number, :homozygote_count, :homoplasmic_count, :heteroplasmic_count)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, estimate := range estimates {
+		if _, err := stmt.ExecContext(ctx, estimate); err != nil {
+			return fmt.Errorf("could not store allele estimate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAlleleEstimates deletes a batch of allele estimates (identified by
+// their variant ID, alleles, ancestry group and source).
+func (db *DB) DeleteAlleleEstimates(ctx context.Context, estimates []AlleleEstimate) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `DELETE FROM allele_estimates
+		WHERE id = :id AND reference = :reference AND alternate = :alternate AND ancestry = :ancestry AND source = :source`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, estimate := range estimates {
+		if _, err := stmt.ExecContext(ctx, estimate); err != nil {
+			return fmt.Errorf("could not delete allele estimate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// AlleleEstimates returns the stored allele estimates for the given variant IDs.
+func (db *DB) AlleleEstimates(ctx context.Context, ids []int64) ([]AlleleEstimate, error) {
+	var estimates []AlleleEstimate
+
+	for start := 0; start < len(ids); start += maxQueryParameters {
+		end := min(start+maxQueryParameters, len(ids))
+
+		query, args, err := sqlx.In(`SELECT id, reference, alternate, ancestry, source, allele_count, allele_number,
+			homozygote_count, homoplasmic_count, heteroplasmic_count FROM allele_estimates WHERE id IN (?)`, ids[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("could not build query: %w", err)
+		}
+
+		var found []AlleleEstimate
+		if err := db.SelectContext(ctx, &found, db.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("could not query allele estimates: %w", err)
+		}
+
+		estimates = append(estimates, found...)
+	}
+
+	return estimates, nil
+}
+
+// AlleleKaryotypeEstimate is a sex-specific allele frequency estimate (for
+// variants on the sex chromosomes), Genobase itself has no notion of these.
+type AlleleKaryotypeEstimate struct {
+	AlleleEstimate
+	Karyotype Karyotype `db:"karyotype"`
+	// Frequency is the allele frequency amongst individuals of this karyotype.
+	Frequency float64 `db:"frequency"`
+}
+
+// StoreAlleleKaryotypeEstimates stores (or replaces) a batch of sex-specific
+// allele estimates.
+func (db *DB) StoreAlleleKaryotypeEstimates(ctx context.Context, estimates []AlleleKaryotypeEstimate) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `INSERT OR REPLACE INTO allele_karyotype_estimates
+		(id, reference, alternate, ancestry, karyotype, frequency, source, allele_count, allele_number, homozygote_count)
+		VALUES (:id, :reference, :alternate, :ancestry, :karyotype, :frequency, :source, :allele_count, :allele_number, :homozygote_count)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, estimate := range estimates {
+		if _, err := stmt.ExecContext(ctx, estimate); err != nil {
+			return fmt.Errorf("could not store allele karyotype estimate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAlleleKaryotypeEstimates deletes a batch of sex-specific allele
+// estimates (identified by their variant ID, alleles, ancestry group,
+// karyotype and source).
+func (db *DB) DeleteAlleleKaryotypeEstimates(ctx context.Context, estimates []AlleleKaryotypeEstimate) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `DELETE FROM allele_karyotype_estimates
+		WHERE id = :id AND reference = :reference AND alternate = :alternate AND ancestry = :ancestry
+		AND karyotype = :karyotype AND source = :source`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, estimate := range estimates {
+		if _, err := stmt.ExecContext(ctx, estimate); err != nil {
+			return fmt.Errorf("could not delete allele karyotype estimate: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// AlleleKaryotypeEstimates returns the stored sex-specific allele estimates
+// for the given variant IDs.
+func (db *DB) AlleleKaryotypeEstimates(ctx context.Context, ids []int64) ([]AlleleKaryotypeEstimate, error) {
+	var estimates []AlleleKaryotypeEstimate
+
+	for start := 0; start < len(ids); start += maxQueryParameters {
+		end := min(start+maxQueryParameters, len(ids))
+
+		query, args, err := sqlx.In(`SELECT id, reference, alternate, ancestry, karyotype, frequency, source,
+			allele_count, allele_number, homozygote_count FROM allele_karyotype_estimates WHERE id IN (?)`, ids[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("could not build query: %w", err)
+		}
+
+		var found []AlleleKaryotypeEstimate
+		if err := db.SelectContext(ctx, &found, db.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("could not query allele karyotype estimates: %w", err)
+		}
+
+		estimates = append(estimates, found...)
+	}
+
+	return estimates, nil
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Checkpoint records how much of a file an import has committed, so an
+// interrupted import can be resumed.
+type Checkpoint struct {
+	// Import is the kind of import (eg. variants).
+	Import string `db:"import"`
+	// Path is the absolute path of the imported file.
+	Path string `db:"path"`
+	// Size and ModifiedAt (in Unix nanoseconds) identify the version of the
+	// file that was imported.
+	Size       int64 `db:"size"`
+	ModifiedAt int64 `db:"modified_at"`
+	// ByteOffset is the offset, in the decompressed file, of the end of the
+	// last committed record.
+	ByteOffset int64 `db:"byte_offset"`
+	// VirtualOffset is the BGZF virtual offset of ByteOffset (if the file is
+	// BGZF compressed).
+	VirtualOffset *int64 `db:"virtual_offset"`
+	// LastRecord identifies the last committed record.
+	LastRecord string `db:"last_record"`
+	// Completed is set once the whole file has been imported.
+	Completed bool `db:"completed"`
+}
+
+// Checkpoint returns the checkpoint of an import of a file, and whether there
+// was one.
+func (db *DB) Checkpoint(ctx context.Context, importName, path string) (*Checkpoint, bool, error) {
+	var checkpoint Checkpoint
+	if err := db.GetContext(ctx, &checkpoint, `SELECT * FROM import_checkpoints WHERE import = ? AND path = ?`, importName, path); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+
+		return nil, false, fmt.Errorf("could not get checkpoint: %w", err)
+	}
+
+	return &checkpoint, true, nil
+}
+
+// SetCheckpoint stores the checkpoint of an import of a file, replacing any
+// previous checkpoint.
+func (db *DB) SetCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	if _, err := db.NamedExecContext(ctx, `INSERT OR REPLACE INTO import_checkpoints
+		(import, path, size, modified_at, byte_offset, virtual_offset, last_record, completed)
+		VALUES (:import, :path, :size, :modified_at, :byte_offset, :virtual_offset, :last_record, :completed)`, checkpoint); err != nil {
+		return fmt.Errorf("could not set checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteCheckpoints deletes the checkpoints of all imports of a file.
+func (db *DB) DeleteCheckpoints(ctx context.Context, path string) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM import_checkpoints WHERE path = ?`, path); err != nil {
+		return fmt.Errorf("could not delete checkpoints: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// ClinVarRecord is the clinical significance of a variant allele as
+// asserted by ClinVar.
+type ClinVarRecord struct {
+	// ID is the dbSNP reference SNP ID (without the rs prefix).
+	ID int64 `db:"id"`
+	// VariationID is the ClinVar variation ID.
+	VariationID int64  `db:"variation_id"`
+	Chromosome  string `db:"chromosome"`
+	Position    int64  `db:"position"`
+	Reference   string `db:"reference"`
+	Alternate   string `db:"alternate"`
+	// ClinicalSignificance is the aggregate clinical significance (CLNSIG).
+	ClinicalSignificance string `db:"clinical_significance"`
+	// ReviewStatus is the ClinVar review status (CLNREVSTAT).
+	ReviewStatus string `db:"review_status"`
+	// DiseaseNames is a pipe separated list of associated conditions (CLNDN).
+	DiseaseNames string `db:"disease_names"`
+	// Genes is a pipe separated list of gene symbol:ID pairs (GENEINFO).
+	Genes string `db:"genes"`
+}
+
+// StoreClinVarRecords stores (or replaces) a batch of ClinVar records.
+func (db *DB) StoreClinVarRecords(ctx context.Context, records []ClinVarRecord) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `INSERT OR REPLACE INTO clinvar_records
+		(id, variation_id, chromosome, position, reference, alternate, clinical_significance, review_status, disease_names, genes)
+		VALUES (:id, :variation_id, :chromosome, :position, :reference, :alternate, :clinical_significance, :review_status, :disease_names, :genes)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, record := range records {
+		if _, err := stmt.ExecContext(ctx, record); err != nil {
+			return fmt.Errorf("could not store clinvar record: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
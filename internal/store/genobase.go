@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ExistingVariants returns the subset of the given variant IDs which are
+// present in the Genobase variant table.
+func (db *DB) ExistingVariants(ctx context.Context, ids []int64) (map[int64]bool, error) {
+	existing := make(map[int64]bool)
+
+	for start := 0; start < len(ids); start += maxQueryParameters {
+		end := min(start+maxQueryParameters, len(ids))
+
+		query, args, err := sqlx.In(`SELECT id FROM variant WHERE id IN (?)`, ids[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("could not build query: %w", err)
+		}
+
+		var found []int64
+		if err := db.SelectContext(ctx, &found, db.Rebind(query), args...); err != nil {
+			return nil, fmt.Errorf("could not query variants: %w", err)
+		}
+
+		for _, id := range found {
+			existing[id] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// Locus is a position on a chromosome.
+type Locus struct {
+	Chromosome string
+	Position   int64
+}
+
+// VariantsAt returns the IDs of the variants in the Genobase variant table at
+// each of the given loci (chromosomes are named as in Genobase, eg. 1, X, MT
+// or PAR). Loci without any variants are omitted.
+func (db *DB) VariantsAt(ctx context.Context, loci []Locus) (map[Locus][]int64, error) {
+	positions := make(map[string][]int64)
+	for _, locus := range loci {
+		positions[locus.Chromosome] = append(positions[locus.Chromosome], locus.Position)
+	}
+
+	found := make(map[Locus][]int64)
+	for chromosome, chromosomePositions := range positions {
+		for start := 0; start < len(chromosomePositions); start += maxQueryParameters {
+			end := min(start+maxQueryParameters, len(chromosomePositions))
+
+			query, args, err := sqlx.In(`SELECT id, position FROM variant WHERE chromosome = ? AND position IN (?)`,
+				chromosome, chromosomePositions[start:end])
+			if err != nil {
+				return nil, fmt.Errorf("could not build query: %w", err)
+			}
+
+			var variants []struct {
+				ID       int64 `db:"id"`
+				Position int64 `db:"position"`
+			}
+			if err := db.SelectContext(ctx, &variants, db.Rebind(query), args...); err != nil {
+				return nil, fmt.Errorf("could not query variants: %w", err)
+			}
+
+			for _, variant := range variants {
+				locus := Locus{Chromosome: chromosome, Position: variant.Position}
+				if !slices.Contains(found[locus], variant.ID) {
+					found[locus] = append(found[locus], variant.ID)
+				}
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// CountKnownAlleles returns the number of distinct variant IDs in the
+// Genobase allele table.
+func (db *DB) CountKnownAlleles(ctx context.Context) (int64, error) {
+	var count int64
+	if err := db.GetContext(ctx, &count, `SELECT COUNT(DISTINCT id) FROM allele`); err != nil {
+		return 0, fmt.Errorf("could not count alleles: %w", err)
+	}
+
+	return count, nil
+}
+
+// KnownAlleles calls fn with each distinct variant ID in the Genobase allele
+// table, in ascending order.
+func (db *DB) KnownAlleles(ctx context.Context, fn func(id int64) error) error {
+	rows, err := db.QueryxContext(ctx, `SELECT DISTINCT id FROM allele ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("could not query alleles: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("could not scan allele: %w", err)
+		}
+
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not scan alleles: %w", err)
+	}
+
+	return nil
+}
+
+// MergedKnownAlleles returns the current IDs of any retired variant IDs in
+// the Genobase allele table, in ascending order. Aliases must be flattened.
+func (db *DB) MergedKnownAlleles(ctx context.Context) ([]int64, error) {
+	var ids []int64
+	if err := db.SelectContext(ctx, &ids, `SELECT DISTINCT current_id FROM rsid_aliases
+		WHERE retired_id IN (SELECT id FROM allele) ORDER BY current_id`); err != nil {
+		return nil, fmt.Errorf("could not query merged alleles: %w", err)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// GWASAssociationKind describes how the variants of an association combine.
+type GWASAssociationKind string
+
+const (
+	// GWASAssociationKindSingle is an association with a single variant.
+	GWASAssociationKindSingle GWASAssociationKind = "single"
+	// GWASAssociationKindHaplotype is an association with a haplotype
+	// made up of several variants.
+	GWASAssociationKindHaplotype GWASAssociationKind = "haplotype"
+	// GWASAssociationKindInteraction is an association with an interaction
+	// between several variants (eg. rs1 x rs2).
+	GWASAssociationKindInteraction GWASAssociationKind = "interaction"
+)
+
+// GWASAssociation is a trait association reported by the GWAS Catalog.
+type GWASAssociation struct {
+	// ID is assigned by the database when the association is stored.
+	ID             int64               `db:"id"`
+	StudyAccession string              `db:"study_accession"`
+	PubMedID       int64               `db:"pubmed_id"`
+	Trait          string              `db:"trait"`
+	MappedTrait    string              `db:"mapped_trait"`
+	Kind           GWASAssociationKind `db:"kind"`
+	PValue         *float64            `db:"p_value"`
+	// PValueText is any free text qualifier of the p-value (eg. "(EA)").
+	PValueText string `db:"p_value_text"`
+	// EffectSize is the odds ratio, or beta coefficient.
+	EffectSize         *float64 `db:"effect_size"`
+	ConfidenceInterval string   `db:"confidence_interval"`
+	// Variants are the variants (in reported order) of the association.
+	Variants []GWASAssociationVariant `db:"-"`
+}
+
+// GWASAssociationVariant is one of the variants of a GWAS association.
+type GWASAssociationVariant struct {
+	AssociationID int64 `db:"association_id"`
+	Index         int   `db:"idx"`
+	// ID is the dbSNP reference SNP ID (without the rs prefix), if the
+	// variant has one.
+	ID *int64 `db:"id"`
+	// SNP is the variant as reported by the GWAS Catalog (eg. rs123 or chr1:123).
+	SNP        string `db:"snp"`
+	RiskAllele string `db:"risk_allele"`
+}
+
+// ClearStagedGWASAssociations removes any staged GWAS associations (eg. left
+// behind by a failed import).
+func (db *DB) ClearStagedGWASAssociations(ctx context.Context) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM gwas_association_variants_staging`); err != nil {
+		return fmt.Errorf("could not delete staged gwas association variants: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM gwas_associations_staging`); err != nil {
+		return fmt.Errorf("could not delete staged gwas associations: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceGWASAssociations replaces all previously imported GWAS associations
+// with the staged associations, in a single transaction.
+func (db *DB) ReplaceGWASAssociations(ctx context.Context) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, query := range []string{
+		`DELETE FROM gwas_association_variants`,
+		`DELETE FROM gwas_associations`,
+		`INSERT INTO gwas_associations
+			(id, study_accession, pubmed_id, trait, mapped_trait, kind, p_value, p_value_text, effect_size, confidence_interval)
+			SELECT id, study_accession, pubmed_id, trait, mapped_trait, kind, p_value, p_value_text, effect_size, confidence_interval
+			FROM gwas_associations_staging`,
+		`INSERT INTO gwas_association_variants (association_id, idx, id, snp, risk_allele)
+			SELECT association_id, idx, id, snp, risk_allele FROM gwas_association_variants_staging`,
+		`DELETE FROM gwas_association_variants_staging`,
+		`DELETE FROM gwas_associations_staging`,
+	} {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("could not replace gwas associations: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// StageGWASAssociations stages a batch of GWAS associations (and their
+// variants), see ReplaceGWASAssociations.
+func (db *DB) StageGWASAssociations(ctx context.Context, associations []GWASAssociation) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	associationStmt, err := tx.PrepareNamedContext(ctx, `INSERT INTO gwas_associations_staging
+		(study_accession, pubmed_id, trait, mapped_trait, kind, p_value, p_value_text, effect_size, confidence_interval)
+		VALUES (:study_accession, :pubmed_id, :trait, :mapped_trait, :kind, :p_value, :p_value_text, :effect_size, :confidence_interval)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer associationStmt.Close()
+
+	variantStmt, err := tx.PrepareNamedContext(ctx, `INSERT INTO gwas_association_variants_staging
+		(association_id, idx, id, snp, risk_allele)
+		VALUES (:association_id, :idx, :id, :snp, :risk_allele)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer variantStmt.Close()
+
+	for i := range associations {
+		res, err := associationStmt.ExecContext(ctx, associations[i])
+		if err != nil {
+			return fmt.Errorf("could not store gwas association: %w", err)
+		}
+
+		associations[i].ID, err = res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("could not get gwas association id: %w", err)
+		}
+
+		for j := range associations[i].Variants {
+			associations[i].Variants[j].AssociationID = associations[i].ID
+			associations[i].Variants[j].Index = j
+
+			if _, err := variantStmt.ExecContext(ctx, associations[i].Variants[j]); err != nil {
+				return fmt.Errorf("could not store gwas association variant: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Index is an index of a table.
+type Index struct {
+	Name  string `db:"name"`
+	Table string `db:"table_name"`
+	SQL   string `db:"sql"`
+}
+
+// DropIndexes drops the indexes of the given tables, so rows can be loaded
+// faster. Indexes backing primary keys or unique constraints are kept. The
+// dropped indexes are remembered until they are restored.
+func (db *DB) DropIndexes(ctx context.Context, tables []string) ([]Index, error) {
+	query, args, err := sqlx.In(`SELECT name, tbl_name AS table_name, sql FROM sqlite_master
+		WHERE type = 'index' AND sql IS NOT NULL AND sql NOT LIKE 'CREATE UNIQUE %' AND tbl_name IN (?)`, tables)
+	if err != nil {
+		return nil, fmt.Errorf("could not build query: %w", err)
+	}
+
+	var indexes []Index
+	if err := db.SelectContext(ctx, &indexes, db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("could not query indexes: %w", err)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, index := range indexes {
+		if _, err := tx.NamedExecContext(ctx, `INSERT INTO dropped_indexes (name, table_name, sql)
+			VALUES (:name, :table_name, :sql)`, index); err != nil {
+			return nil, fmt.Errorf("could not record index %s: %w", index.Name, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DROP INDEX "%s"`, index.Name)); err != nil {
+			return nil, fmt.Errorf("could not drop index %s: %w", index.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return indexes, nil
+}
+
+// DroppedIndexes returns the indexes which have been dropped, and not yet
+// restored.
+func (db *DB) DroppedIndexes(ctx context.Context) ([]Index, error) {
+	var indexes []Index
+	if err := db.SelectContext(ctx, &indexes, `SELECT name, table_name, sql FROM dropped_indexes ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("could not query dropped indexes: %w", err)
+	}
+
+	return indexes, nil
+}
+
+// RestoreIndex recreates a dropped index.
+func (db *DB) RestoreIndex(ctx context.Context, index Index) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, index.SQL); err != nil {
+		return fmt.Errorf("could not create index %s: %w", index.Name, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM dropped_indexes WHERE name = ?`, index.Name); err != nil {
+		return fmt.Errorf("could not delete dropped index %s: %w", index.Name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Reindex rebuilds every index.
+func (db *DB) Reindex(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, `REINDEX`); err != nil {
+		return fmt.Errorf("could not rebuild indexes: %w", err)
+	}
+
+	return nil
+}
+
+// Analyze gathers the statistics used by the query planner.
+func (db *DB) Analyze(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, `ANALYZE`); err != nil {
+		return fmt.Errorf("could not analyze database: %w", err)
+	}
+
+	return nil
+}
+
+// Vacuum rebuilds the database file, reclaiming any free space. If path is
+// set the rebuilt database is written there instead (which must not exist).
+func (db *DB) Vacuum(ctx context.Context, path string) error {
+	var err error
+	if path != "" {
+		_, err = db.ExecContext(ctx, `VACUUM INTO ?`, path)
+	} else {
+		_, err = db.ExecContext(ctx, `VACUUM`)
+	}
+	if err != nil {
+		return fmt.Errorf("could not vacuum database: %w", err)
+	}
+
+	return nil
+}
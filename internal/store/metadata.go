@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MetadataVariantsReference is the reference assembly (eg. GRCh38) the
+	// stored variant positions are relative to.
+	MetadataVariantsReference = "variants_reference"
+)
+
+// MetadataMinimumFrequency is the key of the minimum allele frequency a gnoMAD
+// dataset was last imported with (estimates of rarer alleles aren't stored).
+func MetadataMinimumFrequency(source AlleleSource) string {
+	return "minimum_frequency_" + string(source)
+}
+
+// Metadata returns the value of a metadata key, and whether it was set.
+func (db *DB) Metadata(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	if err := db.GetContext(ctx, &value, `SELECT value FROM import_metadata WHERE key = ?`, key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+
+		return "", false, fmt.Errorf("could not get metadata: %w", err)
+	}
+
+	return value, true, nil
+}
+
+// SetMetadata sets the value of a metadata key.
+func (db *DB) SetMetadata(ctx context.Context, key, value string) error {
+	if _, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO import_metadata (key, value) VALUES (?, ?)`, key, value); err != nil {
+		return fmt.Errorf("could not set metadata: %w", err)
+	}
+
+	return nil
+}
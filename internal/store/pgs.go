@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// PGSScore is the metadata of a PGS Catalog polygenic score.
+type PGSScore struct {
+	// ID is the PGS Catalog score ID (eg. PGS000001).
+	ID            string `db:"id"`
+	Name          string `db:"name"`
+	TraitReported string `db:"trait_reported"`
+	TraitMapped   string `db:"trait_mapped"`
+	TraitEFO      string `db:"trait_efo"`
+	WeightType    string `db:"weight_type"`
+	// GenomeBuild is the build the score was originally published against.
+	GenomeBuild string `db:"genome_build"`
+	// HarmonizedBuild is the build the score positions were harmonized to.
+	HarmonizedBuild string `db:"harmonized_build"`
+	VariantsNumber  int64  `db:"variants_number"`
+	// PublicationID is the PGS Catalog publication ID (eg. PGP000001).
+	PublicationID string `db:"publication_id"`
+	Citation      string `db:"citation"`
+	License       string `db:"license"`
+}
+
+// PGSWeight is the effect weight of a single variant in a polygenic score.
+type PGSWeight struct {
+	ScoreID string `db:"score_id"`
+	Index   int64  `db:"idx"`
+	// ID is the dbSNP reference SNP ID (without the rs prefix), if the
+	// variant has one.
+	ID           *int64  `db:"id"`
+	Chromosome   string  `db:"chromosome"`
+	Position     *int64  `db:"position"`
+	EffectAllele string  `db:"effect_allele"`
+	OtherAllele  string  `db:"other_allele"`
+	Weight       float64 `db:"weight"`
+}
+
+// StorePGSScore stores (or replaces) the metadata of a polygenic score, any
+// previously stored weights for the score are removed.
+func (db *DB) StorePGSScore(ctx context.Context, score PGSScore) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM pgs_weights WHERE score_id = ?`, score.ID); err != nil {
+		return fmt.Errorf("could not delete pgs weights: %w", err)
+	}
+
+	if _, err := tx.NamedExecContext(ctx, `INSERT OR REPLACE INTO pgs_scores
+		(id, name, trait_reported, trait_mapped, trait_efo, weight_type, genome_build, harmonized_build, variants_number, publication_id, citation, license)
+		VALUES (:id, :name, :trait_reported, :trait_mapped, :trait_efo, :weight_type, :genome_build, :harmonized_build, :variants_number, :publication_id, :citation, :license)`, score); err != nil {
+		return fmt.Errorf("could not store pgs score: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// StorePGSWeights stores a batch of polygenic score weights.
+func (db *DB) StorePGSWeights(ctx context.Context, weights []PGSWeight) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.PrepareNamedContext(ctx, `INSERT OR REPLACE INTO pgs_weights
+		(score_id, idx, id, chromosome, position, effect_allele, other_allele, weight)
+		VALUES (:score_id, :idx, :id, :chromosome, :position, :effect_allele, :other_allele, :weight)`)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, weight := range weights {
+		if _, err := stmt.ExecContext(ctx, weight); err != nil {
+			return fmt.Errorf("could not store pgs weight: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
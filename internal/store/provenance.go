@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Provenance records where the data imported from a file came from.
+type Provenance struct {
+	ID int64 `db:"id"`
+	// Import is the kind of import (eg. variants).
+	Import   string `db:"import"`
+	FileName string `db:"file_name"`
+	Size     int64  `db:"size"`
+	// SHA256 is the hex encoded digest of the file (empty if the import was
+	// interrupted before it could be computed).
+	SHA256 string `db:"sha256"`
+	// FileDate, Source and Reference are from the VCF header (if present).
+	FileDate  string `db:"file_date"`
+	Source    string `db:"source"`
+	Reference string `db:"reference"`
+	// Options are the (JSON encoded) options of the import.
+	Options         string    `db:"options"`
+	ImporterVersion string    `db:"importer_version"`
+	StartedAt       time.Time `db:"started_at"`
+	FinishedAt      time.Time `db:"finished_at"`
+	// Status is the outcome of the import (eg. imported or failed).
+	Status string `db:"status"`
+	// Stats are the (JSON encoded) statistics of the import, if it keeps
+	// any.
+	Stats string `db:"stats"`
+}
+
+// StoreProvenance records the provenance of an imported file.
+func (db *DB) StoreProvenance(ctx context.Context, provenance *Provenance) error {
+	if _, err := db.NamedExecContext(ctx, `INSERT INTO import_provenance
+		(import, file_name, size, sha256, file_date, source, reference, options, importer_version, started_at, finished_at, status, stats)
+		VALUES (:import, :file_name, :size, :sha256, :file_date, :source, :reference, :options, :importer_version, :started_at, :finished_at, :status, :stats)`, provenance); err != nil {
+		return fmt.Errorf("could not store provenance: %w", err)
+	}
+
+	return nil
+}
+
+// Provenance returns the provenance of every imported file, oldest first.
+func (db *DB) Provenance(ctx context.Context) ([]Provenance, error) {
+	var provenance []Provenance
+	if err := db.SelectContext(ctx, &provenance, `SELECT * FROM import_provenance ORDER BY id`); err != nil {
+		return nil, fmt.Errorf("could not get provenance: %w", err)
+	}
+
+	return provenance, nil
+}
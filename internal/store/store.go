@@ -0,0 +1,297 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package store manages the tables the importer maintains alongside the
+// Genobase schema (eg. annotations that Genobase itself doesn't model).
+package store
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The maximum number of parameters to bind in a single query.
+const maxQueryParameters = 500
+
+// Schema migrations, applied in order. Never edit an existing migration,
+// only append new ones.
+var migrations = []string{
+	`CREATE TABLE clinvar_records (
+		id INTEGER NOT NULL,
+		variation_id INTEGER NOT NULL,
+		chromosome TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		alternate TEXT NOT NULL,
+		clinical_significance TEXT NOT NULL,
+		review_status TEXT NOT NULL,
+		disease_names TEXT NOT NULL,
+		genes TEXT NOT NULL,
+		PRIMARY KEY (id, variation_id)
+	)`,
+	`CREATE TABLE gwas_associations (
+		id INTEGER PRIMARY KEY,
+		study_accession TEXT NOT NULL,
+		pubmed_id INTEGER NOT NULL,
+		trait TEXT NOT NULL,
+		mapped_trait TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		p_value REAL,
+		p_value_text TEXT NOT NULL,
+		effect_size REAL,
+		confidence_interval TEXT NOT NULL
+	)`,
+	`CREATE TABLE gwas_association_variants (
+		association_id INTEGER NOT NULL REFERENCES gwas_associations (id) ON DELETE CASCADE,
+		idx INTEGER NOT NULL,
+		id INTEGER,
+		snp TEXT NOT NULL,
+		risk_allele TEXT NOT NULL,
+		PRIMARY KEY (association_id, idx)
+	)`,
+	`CREATE INDEX gwas_association_variants_id ON gwas_association_variants (id)`,
+	`CREATE TABLE pgs_scores (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		trait_reported TEXT NOT NULL,
+		trait_mapped TEXT NOT NULL,
+		trait_efo TEXT NOT NULL,
+		weight_type TEXT NOT NULL,
+		genome_build TEXT NOT NULL,
+		harmonized_build TEXT NOT NULL,
+		variants_number INTEGER NOT NULL,
+		publication_id TEXT NOT NULL,
+		citation TEXT NOT NULL,
+		license TEXT NOT NULL
+	)`,
+	`CREATE TABLE pgs_weights (
+		score_id TEXT NOT NULL REFERENCES pgs_scores (id) ON DELETE CASCADE,
+		idx INTEGER NOT NULL,
+		id INTEGER,
+		chromosome TEXT NOT NULL,
+		position INTEGER,
+		effect_allele TEXT NOT NULL,
+		other_allele TEXT NOT NULL,
+		weight REAL NOT NULL,
+		PRIMARY KEY (score_id, idx)
+	)`,
+	`CREATE INDEX pgs_weights_id ON pgs_weights (id)`,
+	`CREATE TABLE rsid_aliases (
+		retired_id INTEGER PRIMARY KEY,
+		current_id INTEGER NOT NULL
+	)`,
+	`CREATE INDEX rsid_aliases_current_id ON rsid_aliases (current_id)`,
+	`CREATE TABLE import_metadata (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`CREATE TABLE allele_estimates (
+		id INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		alternate TEXT NOT NULL,
+		ancestry TEXT NOT NULL,
+		source TEXT NOT NULL,
+		allele_count INTEGER,
+		allele_number INTEGER,
+		PRIMARY KEY (id, reference, alternate, ancestry)
+	)`,
+	`ALTER TABLE allele_estimates ADD COLUMN homozygote_count INTEGER`,
+	`ALTER TABLE allele_estimates ADD COLUMN homoplasmic_count INTEGER`,
+	`ALTER TABLE allele_estimates ADD COLUMN heteroplasmic_count INTEGER`,
+	`CREATE TABLE allele_karyotype_estimates (
+		id INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		alternate TEXT NOT NULL,
+		ancestry TEXT NOT NULL,
+		karyotype TEXT NOT NULL,
+		frequency REAL NOT NULL,
+		source TEXT NOT NULL,
+		allele_count INTEGER,
+		allele_number INTEGER,
+		homozygote_count INTEGER,
+		PRIMARY KEY (id, reference, alternate, ancestry, karyotype)
+	)`,
+	`CREATE TABLE import_checkpoints (
+		import TEXT NOT NULL,
+		path TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		modified_at INTEGER NOT NULL,
+		byte_offset INTEGER NOT NULL,
+		virtual_offset INTEGER,
+		last_record TEXT NOT NULL,
+		completed BOOLEAN NOT NULL,
+		PRIMARY KEY (import, path)
+	)`,
+	`CREATE TABLE import_provenance (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		import TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		file_date TEXT NOT NULL,
+		source TEXT NOT NULL,
+		reference TEXT NOT NULL,
+		options TEXT NOT NULL,
+		importer_version TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP NOT NULL,
+		status TEXT NOT NULL
+	)`,
+	`ALTER TABLE import_provenance ADD COLUMN stats TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE dropped_indexes (
+		name TEXT PRIMARY KEY,
+		table_name TEXT NOT NULL,
+		sql TEXT NOT NULL
+	)`,
+	`CREATE TABLE gwas_associations_staging (
+		id INTEGER PRIMARY KEY,
+		study_accession TEXT NOT NULL,
+		pubmed_id INTEGER NOT NULL,
+		trait TEXT NOT NULL,
+		mapped_trait TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		p_value REAL,
+		p_value_text TEXT NOT NULL,
+		effect_size REAL,
+		confidence_interval TEXT NOT NULL
+	)`,
+	`CREATE TABLE gwas_association_variants_staging (
+		association_id INTEGER NOT NULL REFERENCES gwas_associations_staging (id) ON DELETE CASCADE,
+		idx INTEGER NOT NULL,
+		id INTEGER,
+		snp TEXT NOT NULL,
+		risk_allele TEXT NOT NULL,
+		PRIMARY KEY (association_id, idx)
+	)`,
+	// Keep the estimates of each gnoMAD dataset alongside joint estimates.
+	`CREATE TABLE allele_estimates_by_source (
+		id INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		alternate TEXT NOT NULL,
+		ancestry TEXT NOT NULL,
+		source TEXT NOT NULL,
+		allele_count INTEGER,
+		allele_number INTEGER,
+		homozygote_count INTEGER,
+		homoplasmic_count INTEGER,
+		heteroplasmic_count INTEGER,
+		PRIMARY KEY (id, reference, alternate, ancestry, source)
+	)`,
+	`INSERT INTO allele_estimates_by_source
+		(id, reference, alternate, ancestry, source, allele_count, allele_number, homozygote_count, homoplasmic_count, heteroplasmic_count)
+		SELECT id, reference, alternate, ancestry, source, allele_count, allele_number, homozygote_count, homoplasmic_count, heteroplasmic_count
+		FROM allele_estimates`,
+	`DROP TABLE allele_estimates`,
+	`ALTER TABLE allele_estimates_by_source RENAME TO allele_estimates`,
+	`CREATE TABLE allele_karyotype_estimates_by_source (
+		id INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		alternate TEXT NOT NULL,
+		ancestry TEXT NOT NULL,
+		karyotype TEXT NOT NULL,
+		frequency REAL NOT NULL,
+		source TEXT NOT NULL,
+		allele_count INTEGER,
+		allele_number INTEGER,
+		homozygote_count INTEGER,
+		PRIMARY KEY (id, reference, alternate, ancestry, karyotype, source)
+	)`,
+	`INSERT INTO allele_karyotype_estimates_by_source
+		(id, reference, alternate, ancestry, karyotype, frequency, source, allele_count, allele_number, homozygote_count)
+		SELECT id, reference, alternate, ancestry, karyotype, frequency, source, allele_count, allele_number, homozygote_count
+		FROM allele_karyotype_estimates`,
+	`DROP TABLE allele_karyotype_estimates`,
+	`ALTER TABLE allele_karyotype_estimates_by_source RENAME TO allele_karyotype_estimates`,
+}
+
+// DB is a handle to the importer managed tables within a Genobase DB.
+type DB struct {
+	*sqlx.DB
+	logger *slog.Logger
+}
+
+// Open opens the importer managed tables within the Genobase DB at the given
+// path, creating or migrating them as required.
+func Open(ctx context.Context, logger *slog.Logger, path string, noSync bool) (*DB, error) {
+	params := url.Values{}
+	params.Set("_busy_timeout", "60000")
+	if noSync {
+		params.Set("_sync", "OFF")
+	}
+
+	sqlDB, err := sqlx.Open("sqlite3", fmt.Sprintf("file:%s?%s", path, params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+
+	db := &DB{
+		DB:     sqlDB,
+		logger: logger,
+	}
+
+	if err := db.migrate(ctx); err != nil {
+		_ = sqlDB.Close()
+		return nil, fmt.Errorf("could not migrate database: %w", err)
+	}
+
+	return db, nil
+}
+
+func (db *DB) migrate(ctx context.Context) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS importer_migrations (
+		version INTEGER PRIMARY KEY
+	)`); err != nil {
+		return fmt.Errorf("could not create migrations table: %w", err)
+	}
+
+	var version int
+	if err := db.GetContext(ctx, &version, `SELECT COALESCE(MAX(version), 0) FROM importer_migrations`); err != nil {
+		return fmt.Errorf("could not get schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		db.logger.Debug("Applying migration", "version", i+1)
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("could not begin transaction: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("could not apply migration %d: %w", i+1, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO importer_migrations (version) VALUES (?)`, i+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("could not record migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("could not commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
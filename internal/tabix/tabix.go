@@ -0,0 +1,324 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tabix reads tabix (.tbi) and coordinate sorted (.csi) indexes of
+// BGZF compressed files.
+package tabix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zymatik-com/importer/internal/bgzf"
+)
+
+const (
+	// The binning scheme used by tabix indexes.
+	tbiMinShift = 14
+	tbiDepth    = 5
+)
+
+// Chunk is a range of virtual offsets.
+type Chunk struct {
+	Begin bgzf.VirtualOffset
+	End   bgzf.VirtualOffset
+}
+
+// Index is a tabix or CSI index.
+type Index struct {
+	// Names are the sequence names, in the order they appear in the file (may
+	// be empty for CSI indexes that don't record them).
+	Names    []string
+	minShift int
+	depth    int
+	refs     []reference
+}
+
+type reference struct {
+	bins map[uint32][]Chunk
+	// The smallest virtual offset of any record in each bin (CSI only).
+	binOffsets map[uint32]bgzf.VirtualOffset
+	// The smallest virtual offset of any record in each 16kbp window (TBI only).
+	intervals []bgzf.VirtualOffset
+}
+
+// Open reads the index at the given path (the format is determined by its
+// magic number rather than its extension).
+func Open(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Indexes are BGZF compressed, which is valid multi-member gzip.
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress index: %w", err)
+	}
+	defer zr.Close()
+
+	return Read(zr)
+}
+
+// Read reads a (decompressed) tabix or CSI index.
+func Read(r io.Reader) (*Index, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("could not read index magic: %w", err)
+	}
+
+	ir := &indexReader{r: r}
+
+	var idx *Index
+	switch string(magic[:]) {
+	case "TBI\x01":
+		idx = ir.readTBI()
+	case "CSI\x01":
+		idx = ir.readCSI()
+	default:
+		return nil, errors.New("not a tabix or csi index")
+	}
+
+	if ir.err != nil {
+		return nil, fmt.Errorf("could not read index: %w", ir.err)
+	}
+
+	return idx, nil
+}
+
+// Chunks returns the chunks of the file which may hold records overlapping
+// the 1-based inclusive range [start, end] of the given sequence. An end of
+// zero means the end of the sequence.
+func (idx *Index) Chunks(tid int, start, end uint64) []Chunk {
+	if tid < 0 || tid >= len(idx.refs) {
+		return nil
+	}
+	ref := idx.refs[tid]
+
+	maxEnd := uint64(1) << (idx.minShift + idx.depth*3)
+	if end == 0 || end > maxEnd {
+		end = maxEnd
+	}
+
+	beg := start
+	if beg > 0 {
+		beg--
+	}
+
+	// Records before this offset can't overlap the range.
+	var minOffset bgzf.VirtualOffset
+	if len(ref.intervals) > 0 {
+		i := min(int(beg>>tbiMinShift), len(ref.intervals)-1)
+		minOffset = ref.intervals[i]
+	} else if len(ref.binOffsets) > 0 {
+		minOffset = ref.minOffset(beg, idx.minShift, idx.depth)
+	}
+
+	var chunks []Chunk
+	for _, bin := range reg2bins(beg, end, idx.minShift, idx.depth) {
+		chunks = append(chunks, ref.bins[bin]...)
+	}
+
+	filtered := chunks[:0]
+	for _, chunk := range chunks {
+		if chunk.End > minOffset {
+			filtered = append(filtered, chunk)
+		}
+	}
+
+	return filtered
+}
+
+// minOffset returns the smallest virtual offset of any record which may
+// overlap a range starting at the 0-based position beg (CSI only). Like
+// htslib, it uses the offset of the leaf bin holding beg or, if that bin is
+// empty, of the nearest bin to its left (walking up to the parent once the
+// first sibling is reached). Records in those bins all start before beg, so
+// nothing after their first record is skipped.
+func (ref reference) minOffset(beg uint64, minShift, depth int) bgzf.VirtualOffset {
+	first := uint32((1<<(depth*3) - 1) / 7)
+	leaf := beg >> minShift
+	if maxLeaf := uint64(1)<<(depth*3) - 1; leaf > maxLeaf {
+		leaf = maxLeaf
+	}
+
+	bin := first + uint32(leaf)
+	for bin > 0 {
+		if offset, ok := ref.binOffsets[bin]; ok {
+			return offset
+		}
+
+		parent := (bin - 1) >> 3
+		if bin > parent<<3+1 {
+			bin--
+		} else {
+			bin = parent
+		}
+	}
+
+	return ref.binOffsets[0]
+}
+
+// reg2bins returns the bins which may overlap the 0-based half open range
+// [beg, end), see the SAM specification.
+func reg2bins(beg, end uint64, minShift, depth int) []uint32 {
+	end--
+
+	var bins []uint32
+	for l, t, s := 0, 0, minShift+depth*3; l <= depth; l++ {
+		for b := t + int(beg>>s); b <= t+int(end>>s); b++ {
+			bins = append(bins, uint32(b))
+		}
+
+		s -= 3
+		t += 1 << (l * 3)
+	}
+
+	return bins
+}
+
+// indexReader reads little endian index fields, remembering the first error.
+type indexReader struct {
+	r   io.Reader
+	err error
+}
+
+func (ir *indexReader) int32() int32 {
+	return int32(ir.uint32())
+}
+
+func (ir *indexReader) uint32() uint32 {
+	var v uint32
+	ir.read(&v)
+	return v
+}
+
+func (ir *indexReader) uint64() uint64 {
+	var v uint64
+	ir.read(&v)
+	return v
+}
+
+func (ir *indexReader) bytes(n int) []byte {
+	if ir.err != nil || n < 0 {
+		return nil
+	}
+
+	b := make([]byte, n)
+	_, ir.err = io.ReadFull(ir.r, b)
+	return b
+}
+
+func (ir *indexReader) read(v any) {
+	if ir.err == nil {
+		ir.err = binary.Read(ir.r, binary.LittleEndian, v)
+	}
+}
+
+func (ir *indexReader) readTBI() *Index {
+	nRef := ir.int32()
+
+	// The tabix configuration (format, columns, meta character and lines to
+	// skip) isn't needed for VCFs.
+	_ = ir.bytes(24)
+
+	idx := &Index{
+		Names:    parseNames(ir.bytes(int(ir.int32()))),
+		minShift: tbiMinShift,
+		depth:    tbiDepth,
+	}
+
+	for i := int32(0); i < nRef && ir.err == nil; i++ {
+		ref := ir.readBins(false)
+
+		nIntervals := ir.int32()
+		for j := int32(0); j < nIntervals && ir.err == nil; j++ {
+			ref.intervals = append(ref.intervals, bgzf.VirtualOffset(ir.uint64()))
+		}
+
+		idx.refs = append(idx.refs, ref)
+	}
+
+	return idx
+}
+
+func (ir *indexReader) readCSI() *Index {
+	idx := &Index{
+		minShift: int(ir.int32()),
+		depth:    int(ir.int32()),
+	}
+
+	// Tabix (rather than bcftools) CSI indexes hold the tabix configuration,
+	// and sequence names, in the auxiliary data.
+	if aux := ir.bytes(int(ir.int32())); len(aux) >= 28 {
+		nameLength := int(binary.LittleEndian.Uint32(aux[24:]))
+		if len(aux) >= 28+nameLength {
+			idx.Names = parseNames(aux[28 : 28+nameLength])
+		}
+	}
+
+	nRef := ir.int32()
+	for i := int32(0); i < nRef && ir.err == nil; i++ {
+		idx.refs = append(idx.refs, ir.readBins(true))
+	}
+
+	return idx
+}
+
+func (ir *indexReader) readBins(csi bool) reference {
+	ref := reference{
+		bins:       make(map[uint32][]Chunk),
+		binOffsets: make(map[uint32]bgzf.VirtualOffset),
+	}
+
+	nBins := ir.int32()
+	for i := int32(0); i < nBins && ir.err == nil; i++ {
+		bin := ir.uint32()
+		if csi {
+			ref.binOffsets[bin] = bgzf.VirtualOffset(ir.uint64())
+		}
+
+		nChunks := ir.int32()
+		for j := int32(0); j < nChunks && ir.err == nil; j++ {
+			ref.bins[bin] = append(ref.bins[bin], Chunk{
+				Begin: bgzf.VirtualOffset(ir.uint64()),
+				End:   bgzf.VirtualOffset(ir.uint64()),
+			})
+		}
+	}
+
+	return ref
+}
+
+// parseNames splits the NUL terminated sequence names of an index.
+func parseNames(b []byte) []string {
+	b = bytes.TrimRight(b, "\x00")
+	if len(b) == 0 {
+		return nil
+	}
+
+	return strings.Split(string(b), "\x00")
+}
@@ -0,0 +1,268 @@
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tabix
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zymatik-com/importer/internal/bgzf"
+)
+
+// The test VCF, and its indexes, are generated by testdata/gen.go.
+const testVCF = "testdata/test.vcf.gz"
+
+// testRecord is a record of the test VCF.
+type testRecord struct {
+	contig string
+	// The 1-based, inclusive range of the record.
+	start, end uint64
+	id         string
+}
+
+func (r testRecord) overlaps(start, end uint64) bool {
+	return r.start <= end && r.end >= start
+}
+
+// readTestRecords reads every record of the test VCF (with gzip, rather than
+// the bgzf package).
+func readTestRecords(t *testing.T) []testRecord {
+	f, err := os.Open(testVCF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parseRecords(t, zr, nil)
+}
+
+// parseRecords parses the records read from r, until done (if set) reports
+// that a record is past the end of a query.
+func parseRecords(t *testing.T, r io.Reader, done func(testRecord) bool) []testRecord {
+	var records []testRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			t.Fatalf("malformed record: %q", line)
+		}
+
+		pos, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := testRecord{contig: fields[0], start: pos, end: pos + uint64(len(fields[3])) - 1, id: fields[2]}
+		if done != nil && done(record) {
+			break
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+// query returns the records overlapping a range, read (as the importer does)
+// from the first of its chunks until a record past the range.
+func query(t *testing.T, idx *Index, tid int, contig string, start, end uint64) []testRecord {
+	chunks := idx.Chunks(tid, start, end)
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	begin := chunks[0].Begin
+	for _, chunk := range chunks[1:] {
+		begin = min(begin, chunk.Begin)
+	}
+
+	f, err := os.Open(testVCF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(begin.Block(), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bgzf.NewReader(f, 2)
+	defer r.Close()
+
+	if _, err := io.CopyN(io.Discard, r, int64(begin.Offset())); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []testRecord
+	for _, record := range parseRecords(t, r, func(record testRecord) bool {
+		return record.contig != contig || record.start > end
+	}) {
+		if record.overlaps(start, end) {
+			found = append(found, record)
+		}
+	}
+
+	return found
+}
+
+func TestChunks(t *testing.T) {
+	records := readTestRecords(t)
+
+	contigs := []string{"chr1", "chr2"}
+
+	type testQuery struct {
+		contig     string
+		start, end uint64
+	}
+
+	queries := []testQuery{
+		{"chr1", 1, 99},
+		{"chr1", 1, 100},
+		{"chr1", 250, 750},
+		{"chr1", 1001, 16379},
+		{"chr1", 16384, 16384},
+		{"chr1", 16385, 16389},
+		{"chr1", 16390, 19999},
+		{"chr1", 40000, 40000},
+		{"chr1", 59999, 60000},
+		{"chr1", 60000, 65535},
+		{"chr1", 65537, 65537},
+		{"chr1", 1048577, 1048577},
+		{"chr1", 1048579, 1048581},
+		{"chr1", 1048582, 8388607},
+		{"chr1", 8388608, 134217729},
+		{"chr1", 134217730, 1 << 29},
+		{"chr2", 1, 1 << 29},
+		{"chr2", 6, 6},
+		{"chr2", 25000, 35006},
+	}
+
+	// And plenty of random ones.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		start := uint64(rng.Int63n(1<<21)) + 1
+		queries = append(queries, testQuery{"chr1", start, start + uint64(rng.Int63n(1<<(rng.Intn(20)+1)))})
+	}
+
+	for _, ext := range []string{".tbi", ".csi"} {
+		t.Run(ext, func(t *testing.T) {
+			idx, err := Open(testVCF + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(idx.Names, contigs) {
+				t.Fatalf("names = %v, want %v", idx.Names, contigs)
+			}
+
+			for _, q := range queries {
+				var want []testRecord
+				for _, record := range records {
+					if record.contig == q.contig && record.overlaps(q.start, q.end) {
+						want = append(want, record)
+					}
+				}
+
+				got := query(t, idx, slices.Index(contigs, q.contig), q.contig, q.start, q.end)
+				if !slices.Equal(got, want) {
+					t.Errorf("%s:%d-%d = %v, want %v", q.contig, q.start, q.end, ids(got), ids(want))
+				}
+			}
+		})
+	}
+}
+
+func TestChunksUnknownSequence(t *testing.T) {
+	idx, err := Open(testVCF + ".tbi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tid := range []int{-1, 2} {
+		if chunks := idx.Chunks(tid, 1, 0); chunks != nil {
+			t.Errorf("Chunks(%d) = %v, want none", tid, chunks)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	if _, err := Read(bytes.NewReader([]byte("BAI\x01"))); err == nil {
+		t.Error("expected an error reading a BAM index")
+	}
+
+	if _, err := Read(bytes.NewReader([]byte("TBI\x01\x01\x00"))); err == nil {
+		t.Error("expected an error reading a truncated index")
+	}
+}
+
+func TestReg2bins(t *testing.T) {
+	tests := []struct {
+		beg, end uint64
+		want     []uint32
+	}{
+		// The first 16kbp, and its ancestors.
+		{0, 1, []uint32{0, 1, 9, 73, 585, 4681}},
+		{0, 1 << 14, []uint32{0, 1, 9, 73, 585, 4681}},
+		// Spanning the first two leaf bins.
+		{1<<14 - 1, 1<<14 + 1, []uint32{0, 1, 9, 73, 585, 4681, 4682}},
+		// The last leaf bin.
+		{1<<29 - 1, 1 << 29, []uint32{0, 8, 72, 584, 4680, 37448}},
+	}
+
+	for _, tt := range tests {
+		if got := reg2bins(tt.beg, tt.end, tbiMinShift, tbiDepth); !slices.Equal(got, tt.want) {
+			t.Errorf("reg2bins(%d, %d) = %v, want %v", tt.beg, tt.end, got, tt.want)
+		}
+	}
+}
+
+func ids(records []testRecord) []string {
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, fmt.Sprintf("%s(%s:%d-%d)", record.id, record.contig, record.start, record.end))
+	}
+
+	return ids
+}
@@ -0,0 +1,335 @@
+//go:build ignore
+
+/* SPDX-License-Identifier: AGPL-3.0-or-later
+ *
+ * Zymatik Importer - Import data into a Genobase DB.
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Generates test.vcf.gz and its tabix (test.vcf.gz.tbi) and CSI
+// (test.vcf.gz.csi) indexes, following the SAM and tabix specifications
+// (https://samtools.github.io/hts-specs/), with small BGZF blocks so queries
+// span several of them. Run with: go run gen.go
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	minShift = 14
+	depth    = 5
+	// The number of records per BGZF block.
+	recordsPerBlock = 3
+)
+
+type record struct {
+	contig   string
+	pos      int // 1-based
+	ref      string
+	beg, end uint64 // the virtual offsets of the start and end of the line
+}
+
+func main() {
+	contigs := []string{"chr1", "chr2"}
+
+	var records []record
+	add := func(contig string, pos, refLength int) {
+		records = append(records, record{contig: contig, pos: pos, ref: strings.Repeat("A", refLength)})
+	}
+
+	// A cluster at the start, records either side of the 16kbp windows, a
+	// long deletion spanning several windows, sparse records further along
+	// (leaving empty windows and bins), and several records at a single
+	// position.
+	for pos := 100; pos <= 1000; pos += 100 {
+		add("chr1", pos, 1)
+	}
+	add("chr1", 16380, 10)
+	add("chr1", 16384, 1)
+	add("chr1", 16385, 1)
+	add("chr1", 20000, 40000)
+	add("chr1", 32768, 1)
+	add("chr1", 65536, 2)
+	for pos := 100000; pos <= 1000000; pos += 150000 {
+		add("chr1", pos, 1)
+	}
+	add("chr1", 1048577, 3)
+	add("chr1", 1048577, 1)
+	add("chr1", 1048577, 5)
+	add("chr1", 8388608, 1)
+	add("chr1", 134217729, 1)
+	for pos := 5; pos <= 50000; pos += 5000 {
+		add("chr2", pos, 2)
+	}
+
+	var header strings.Builder
+	header.WriteString("##fileformat=VCFv4.2\n")
+	for _, contig := range contigs {
+		fmt.Fprintf(&header, "##contig=<ID=%s>\n", contig)
+	}
+	header.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n")
+
+	var file bytes.Buffer
+	writeBlock(&file, []byte(header.String()))
+
+	for i := 0; i < len(records); i += recordsPerBlock {
+		block := file.Len()
+
+		var data bytes.Buffer
+		for j := i; j < min(i+recordsPerBlock, len(records)); j++ {
+			r := &records[j]
+			r.beg = uint64(block)<<16 | uint64(data.Len())
+			fmt.Fprintf(&data, "%s\t%d\trs%d\t%s\tT\t.\tPASS\t.\n", r.contig, r.pos, j+1, r.ref)
+			r.end = uint64(block)<<16 | uint64(data.Len())
+		}
+
+		writeBlock(&file, data.Bytes())
+	}
+
+	writeBlock(&file, nil)
+
+	if err := os.WriteFile("test.vcf.gz", file.Bytes(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	var names bytes.Buffer
+	for _, contig := range contigs {
+		names.WriteString(contig)
+		names.WriteByte(0)
+	}
+
+	// The tabix configuration of a VCF.
+	var config bytes.Buffer
+	for _, v := range []int32{2, 1, 2, 0, '#', 0, int32(names.Len())} {
+		put(&config, v)
+	}
+	config.Write(names.Bytes())
+
+	var tbi, csi bytes.Buffer
+	tbi.WriteString("TBI\x01")
+	put(&tbi, int32(len(contigs)))
+	tbi.Write(config.Bytes())
+
+	csi.WriteString("CSI\x01")
+	put(&csi, int32(minShift))
+	put(&csi, int32(depth))
+	put(&csi, int32(config.Len()))
+	csi.Write(config.Bytes())
+	put(&csi, int32(len(contigs)))
+
+	for _, contig := range contigs {
+		var refRecords []record
+		for _, r := range records {
+			if r.contig == contig {
+				refRecords = append(refRecords, r)
+			}
+		}
+
+		bins, order := binChunks(refRecords)
+
+		// TBI: bins (and their chunks), then the linear index.
+		put(&tbi, int32(len(order)))
+		for _, bin := range order {
+			put(&tbi, bin)
+			put(&tbi, int32(len(bins[bin])))
+			for _, chunk := range bins[bin] {
+				put(&tbi, chunk)
+			}
+		}
+
+		intervals := linearIndex(refRecords)
+		put(&tbi, int32(len(intervals)))
+		for _, offset := range intervals {
+			put(&tbi, offset)
+		}
+
+		// CSI: bins, with the offset of the first record overlapping each.
+		put(&csi, int32(len(order)))
+		for _, bin := range order {
+			put(&csi, bin)
+			put(&csi, firstOverlapping(refRecords, bin))
+			put(&csi, int32(len(bins[bin])))
+			for _, chunk := range bins[bin] {
+				put(&csi, chunk)
+			}
+		}
+	}
+
+	put(&tbi, uint64(0)) // n_no_coor
+	put(&csi, uint64(0))
+
+	for path, index := range map[string][]byte{"test.vcf.gz.tbi": tbi.Bytes(), "test.vcf.gz.csi": csi.Bytes()} {
+		var out bytes.Buffer
+		writeBlock(&out, index)
+		writeBlock(&out, nil)
+
+		if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Sanity check the BGZF file is valid (multi-member) gzip.
+	zr, err := gzip.NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var decompressed bytes.Buffer
+	if _, err := decompressed.ReadFrom(zr); err != nil {
+		log.Fatal(err)
+	}
+
+	if !strings.HasPrefix(decompressed.String(), header.String()) {
+		log.Fatal("BGZF file doesn't start with the header")
+	}
+}
+
+// binChunks returns the chunks of each bin (in the order the bins are first
+// used), merging the chunks of consecutive records in the same bin.
+func binChunks(records []record) (map[uint32][][2]uint64, []uint32) {
+	bins := make(map[uint32][][2]uint64)
+
+	var order []uint32
+	for i, r := range records {
+		beg, end := span(r)
+		bin := reg2bin(beg, end)
+
+		chunks, ok := bins[bin]
+		if !ok {
+			order = append(order, bin)
+		}
+
+		if ok && i > 0 && reg2bin(span(records[i-1])) == bin {
+			chunks[len(chunks)-1][1] = r.end
+			continue
+		}
+
+		bins[bin] = append(chunks, [2]uint64{r.beg, r.end})
+	}
+
+	return bins, order
+}
+
+// linearIndex returns the offset of the first record overlapping each 16kbp
+// window, empty windows take the offset of the next one.
+func linearIndex(records []record) []uint64 {
+	var intervals []uint64
+	var set []bool
+	for _, r := range records {
+		beg, end := span(r)
+		for w := beg >> minShift; w <= (end-1)>>minShift; w++ {
+			for uint64(len(intervals)) <= w {
+				intervals = append(intervals, 0)
+				set = append(set, false)
+			}
+
+			if !set[w] {
+				intervals[w] = r.beg
+				set[w] = true
+			}
+		}
+	}
+
+	for i := len(intervals) - 2; i >= 0; i-- {
+		if !set[i] {
+			intervals[i] = intervals[i+1]
+		}
+	}
+
+	return intervals
+}
+
+// firstOverlapping returns the offset of the first record overlapping a bin.
+func firstOverlapping(records []record, bin uint32) uint64 {
+	binBeg, binEnd := binRange(bin)
+	for _, r := range records {
+		if beg, end := span(r); beg < binEnd && end > binBeg {
+			return r.beg
+		}
+	}
+
+	log.Fatalf("no record overlaps bin %d", bin)
+	return 0
+}
+
+// span returns the 0-based, half open range of a record.
+func span(r record) (uint64, uint64) {
+	return uint64(r.pos - 1), uint64(r.pos - 1 + len(r.ref))
+}
+
+// reg2bin is the binning function of the SAM specification (section 5.3).
+func reg2bin(beg, end uint64) uint32 {
+	end--
+	s := uint(minShift)
+	t := uint64((1<<(depth*3) - 1) / 7)
+	for l := depth; l > 0; l-- {
+		if beg>>s == end>>s {
+			return uint32(t + beg>>s)
+		}
+		s += 3
+		t -= 1 << ((l - 1) * 3)
+	}
+
+	return 0
+}
+
+// binRange returns the 0-based, half open range covered by a bin.
+func binRange(bin uint32) (uint64, uint64) {
+	l, t := 0, uint32(0)
+	for bin >= t+1<<(l*3) {
+		t += 1 << (l * 3)
+		l++
+	}
+
+	size := uint64(1) << (minShift + (depth-l)*3)
+	beg := uint64(bin-t) * size
+
+	return beg, beg + size
+}
+
+// writeBlock writes a BGZF block (an empty block marks the end of the file).
+func writeBlock(w *bytes.Buffer, data []byte) {
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, _ = fw.Write(data)
+	_ = fw.Close()
+
+	header := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0, 0}
+	binary.LittleEndian.PutUint16(header[16:], uint16(len(header)+compressed.Len()+8-1))
+
+	w.Write(header)
+	w.Write(compressed.Bytes())
+	put(w, crc32.ChecksumIEEE(data))
+	put(w, uint32(len(data)))
+}
+
+func put(w *bytes.Buffer, v any) {
+	if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -20,16 +20,30 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/urfave/cli/v2"
 	"github.com/zymatik-com/genobase"
+	"github.com/zymatik-com/importer/internal/fetch"
 	"github.com/zymatik-com/importer/internal/importer"
+	"github.com/zymatik-com/importer/internal/store"
 	"github.com/zymatik-com/nucleo/names"
 )
 
+// The exit status when interrupted by a signal (as for SIGINT in a shell).
+const exitInterrupted = 130
+
 func main() {
 	var logger *slog.Logger
 	var showProgress bool
@@ -69,17 +83,244 @@ func main() {
 		},
 	}
 
+	// cacheDirFlag sets where downloaded files are cached.
+	cacheDirFlag := &cli.StringFlag{
+		Name:  "cache-dir",
+		Usage: "Where to cache files downloaded from URLs",
+		Value: fetch.DefaultDir(),
+	}
+
+	// Flags for commands that import files, which may be downloaded and
+	// verified against their checksums.
+	inputFlags := append([]cli.Flag{
+		cacheDirFlag,
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Verify each file against its published checksum (<file>.sha256 or <file>.md5)",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "checksum",
+			Usage: "The checksum of the file, eg. sha256:<hex> (implies --verify)",
+		},
+	}, sharedFlags...)
+
+	// optimizeFlag optimizes the database once an import is complete.
+	optimizeFlag := &cli.BoolFlag{
+		Name:  "optimize",
+		Usage: "Build indexes, analyze and vacuum the database once the import is complete",
+		Value: false,
+	}
+
+	// Flags for commands that import any number of files.
+	fileFlags := append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "Continue importing the remaining files if one fails",
+			Value: false,
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "The number of rows to store per transaction (the initial number, if adaptive)",
+			Value: importer.DefaultBatchSize,
+		},
+		&cli.Int64Flag{
+			Name:  "batch-bytes",
+			Usage: "The approximate maximum size of a transaction in bytes (0 for no limit)",
+			Value: 0,
+		},
+		&cli.BoolFlag{
+			Name:  "adaptive-batching",
+			Usage: "Tune the number of rows per transaction from the observed commit latency",
+			Value: false,
+		},
+		optimizeFlag,
+	}, inputFlags...)
+
+	// batchOptions returns how many rows to store per transaction.
+	batchOptions := func(c *cli.Context) importer.BatchOptions {
+		return importer.BatchOptions{
+			Size:     c.Int("batch-size"),
+			Bytes:    c.Int64("batch-bytes"),
+			Adaptive: c.Bool("adaptive-batching"),
+		}
+	}
+
+	// filesOptions returns the options for importing files common to all
+	// commands. Where files come from, and verifying their checksums, doesn't
+	// change what is imported, so isn't recorded as an option.
+	filesOptions := func(c *cli.Context) (importer.FilesOptions, error) {
+		opts := importer.FilesOptions{
+			Import:          c.Command.Name,
+			Options:         commandOptions(c, inputFlags),
+			ContinueOnError: c.Bool("continue-on-error"),
+			Verify:          c.Bool("verify"),
+		}
+
+		if s := c.String("checksum"); s != "" {
+			checksum, err := importer.ParseChecksum(s)
+			if err != nil {
+				return opts, fmt.Errorf("invalid checksum: %w", err)
+			}
+
+			opts.Checksum = checksum
+		}
+
+		return opts, nil
+	}
+
+	// inputPaths returns the local paths of the files to import, expanding
+	// glob patterns and downloading any URLs into the cache.
+	inputPaths := func(c *cli.Context, args []string) ([]string, error) {
+		var cache *fetch.Cache
+		var paths []string
+		seen := make(map[string]bool)
+		for _, arg := range args {
+			var argPaths []string
+			if fetch.IsURL(arg) {
+				if cache == nil {
+					var err error
+					cache, err = fetch.New(logger, c.String("cache-dir"), showProgress)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				path, err := cache.Fetch(c.Context, arg)
+				if err != nil {
+					return nil, err
+				}
+
+				argPaths = []string{path}
+			} else {
+				var err error
+				argPaths, err = importer.ExpandPaths([]string{arg})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			for _, path := range argPaths {
+				if !seen[path] {
+					seen[path] = true
+					paths = append(paths, path)
+				}
+			}
+		}
+
+		return paths, nil
+	}
+
+	// importFiles imports each file (or group of files), displaying their
+	// combined progress and recording their provenance (and statistics).
+	importFiles := func(c *cli.Context, st *store.DB, files [][]string, importFile func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error) error {
+		opts, err := filesOptions(c)
+		if err != nil {
+			return err
+		}
+
+		var progress *importer.Progress
+		if showProgress {
+			var paths []string
+			for _, group := range files {
+				paths = append(paths, group...)
+			}
+
+			progress, err = importer.NewProgress(paths)
+			if err != nil {
+				return err
+			}
+			defer progress.Finish()
+		}
+		opts.Progress = progress
+
+		if path := c.String("rejects"); path != "" {
+			opts.Rejects, err = importer.CreateRejects(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("drop-indexes") {
+			if err := importer.DropIndexes(c.Context, logger, st, c.Command.Name); err != nil {
+				return err
+			}
+		}
+
+		err = importer.ImportFiles(c.Context, logger, st, files, opts, func(ctx context.Context, paths []string, stats *importer.Stats) error {
+			return importFile(ctx, paths, progress, stats)
+		})
+		err = errors.Join(err, opts.Rejects.Close())
+
+		if err == nil && c.Bool("optimize") {
+			return importer.Optimize(c.Context, logger, st, c.String("db"), importer.OptimizeOptions{})
+		}
+
+		// Build any dropped indexes, even if the import failed (or was
+		// interrupted), so the database remains usable.
+		if c.Bool("drop-indexes") {
+			err = errors.Join(err, importer.RestoreIndexes(context.WithoutCancel(c.Context), logger, st))
+		}
+
+		return err
+	}
+
+	// dropIndexesFlag drops the indexes of the tables a bulk import loads.
+	dropIndexesFlag := &cli.BoolFlag{
+		Name:  "drop-indexes",
+		Usage: "Drop the indexes of the loaded tables during the import (building them once it's complete)",
+		Value: false,
+	}
+
+	// rejectsFlag writes the records skipped by an import to a file.
+	rejectsFlag := &cli.StringFlag{
+		Name:  "rejects",
+		Usage: "Write the skipped records, and why they were skipped, to a TSV file",
+	}
+
+	// errorFlags limit how many malformed records an import skips.
+	errorFlags := []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Abort the import on the first malformed record",
+			Value: false,
+		},
+		&cli.IntFlag{
+			Name:  "max-errors",
+			Usage: "Abort the import after skipping this many malformed records in a file (0 for no limit)",
+			Value: 0,
+		},
+	}
+
+	regionFlags := []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "region",
+			Usage: "Only import variants within a region, eg. chr1:1000-2000 (may be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "regions-file",
+			Usage: "A BED file of regions to import variants within",
+		},
+	}
+
 	app := &cli.App{
-		Name:   "importer",
-		Usage:  "Prepare a Genobase DB from public human genomics reference data",
-		Flags:  sharedFlags,
-		Before: init,
+		Name:    "importer",
+		Usage:   "Prepare a Genobase DB from public human genomics reference data",
+		Version: importer.Version(),
+		Flags:   sharedFlags,
+		Before:  init,
 		Commands: []*cli.Command{
 			{
 				Name:      "variants",
 				Usage:     "Import dbSNP variants into a Genobase DB",
-				UsageText: "importer variants [--common | --known] <dbsnp vcf path>",
+				UsageText: "importer variants [-r reference] [--common | --known] [--fasta reference fasta] [-j workers] [--resume] [--strict | --max-errors n] [--rejects tsv path] [--drop-indexes] [--region region]... [--regions-file bed path] [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <dbsnp vcf path or url>...",
 				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "reference",
+						Aliases: []string{"r"},
+						Usage:   "The reference the dbSNP VCF is aligned to (eg. GRCh37)",
+						Value:   "GRCh38",
+					},
 					&cli.BoolFlag{
 						Name:  "common",
 						Usage: "Only import common variants",
@@ -90,13 +331,40 @@ func main() {
 						Usage: "Only import variants we have allele frequencies for",
 						Value: false,
 					},
-				}, sharedFlags...),
+					&cli.StringFlag{
+						Name:  "fasta",
+						Usage: "A reference genome FASTA used to left-align indels (optional)",
+					},
+					&cli.IntFlag{
+						Name:    "workers",
+						Aliases: []string{"j"},
+						Usage:   "The number of records to parse concurrently",
+						Value:   runtime.NumCPU(),
+					},
+					&cli.BoolFlag{
+						Name:  "resume",
+						Usage: "Continue an interrupted import from its last checkpoint",
+						Value: false,
+					},
+					rejectsFlag,
+					dropIndexesFlag,
+				}, append(errorFlags, append(regionFlags, fileFlags...)...)...),
 				Before: init,
 				Action: func(c *cli.Context) error {
-					if c.NArg() != 1 {
+					if c.NArg() < 1 {
 						return fmt.Errorf("missing required dbsnp path argument")
 					}
 
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					paths, err = importer.SortByChromosome(paths)
+					if err != nil {
+						return err
+					}
+
 					dbPath := c.String("db")
 					noSync := c.Bool("no-sync")
 
@@ -106,20 +374,49 @@ func main() {
 					}
 					defer db.Close()
 
-					dbsnpPath := c.Args().First()
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					reference, err := names.Reference(c.String("reference"))
+					if err != nil {
+						return fmt.Errorf("invalid reference: %w", err)
+					}
 
-					logger.Info("Adding dbSNP variants", "path", dbsnpPath)
+					regions, err := parseRegions(c)
+					if err != nil {
+						return err
+					}
+
+					opts := importer.DBSNPOptions{
+						Reference:          reference,
+						CommonOnly:         c.Bool("common"),
+						KnownOnly:          c.Bool("known"),
+						ReferenceFASTAPath: c.String("fasta"),
+						Workers:            c.Int("workers"),
+						Regions:            regions,
+						Resume:             c.Bool("resume"),
+						Strict:             c.Bool("strict"),
+						MaxErrors:          c.Int("max-errors"),
+						Batch:              batchOptions(c),
+					}
 
-					commonOnly := c.Bool("common")
-					knownOnly := c.Bool("known")
+					return importFiles(c, st, eachFile(paths), func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						logger.Info("Adding dbSNP variants", "reference", reference, "path", paths[0])
 
-					return importer.DBSNP(c.Context, logger, db, dbsnpPath, commonOnly, knownOnly, showProgress)
+						return importer.DBSNP(ctx, logger, db, st, paths[0], opts, progress, stats)
+					})
 				},
 			},
 			{
 				Name:      "alleles",
 				Usage:     "Import gnomAD allele frequencies into a Genobase DB",
-				UsageText: "importer alleles [-m frequency] <gnomad vcf path>",
+				UsageText: "importer alleles [-m frequency] [--fasta reference fasta] [--ancestry-mapping mapping file] [--source exome|genome] [--joint] [--sex-specific] [-j workers] [--strict | --max-errors n] [--rejects tsv path] [--drop-indexes] [--region region]... [--regions-file bed path] [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <gnomad vcf path or url>...",
+				Description: "Paths may be glob patterns (eg. for per-chromosome releases). Given both gnomAD exomes and\n" +
+					"genomes VCFs, the two datasets are combined into joint allele frequencies (computed from\n" +
+					"the allele counts of each), pairing the files by chromosome.",
 				Flags: append([]cli.Flag{
 					&cli.Float64Flag{
 						Name:    "minimum-frequency",
@@ -127,13 +424,70 @@ func main() {
 						Usage:   "The minimum allele frequency to include",
 						Value:   0.001, // 0.1% or 1 in 1000.
 					},
-				}, sharedFlags...),
+					&cli.StringFlag{
+						Name:  "ancestry-mapping",
+						Usage: "A file mapping INFO fields to ancestry groups (overrides gnomAD version detection)",
+					},
+					&cli.StringFlag{
+						Name:  "fasta",
+						Usage: "A reference genome FASTA used to left-align indels (optional)",
+					},
+					&cli.StringFlag{
+						Name:  "source",
+						Usage: "The gnomAD dataset being imported, exome or genome (guessed from the file if not set)",
+					},
+					&cli.BoolFlag{
+						Name:  "joint",
+						Usage: "Combine with the previously imported frequencies of the other gnomAD dataset (imported with a minimum frequency of 0)",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "sex-specific",
+						Usage: "Also import XX/XY allele frequencies for variants on the sex chromosomes",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:    "workers",
+						Aliases: []string{"j"},
+						Usage:   "The number of records to parse concurrently",
+						Value:   runtime.NumCPU(),
+					},
+					rejectsFlag,
+					dropIndexesFlag,
+				}, append(errorFlags, append(regionFlags, fileFlags...)...)...),
 				Before: init,
 				Action: func(c *cli.Context) error {
-					if c.NArg() != 1 {
+					if c.NArg() < 1 {
 						return fmt.Errorf("missing required gnomad path argument")
 					}
 
+					var source store.AlleleSource
+					switch c.String("source") {
+					case "":
+					case string(store.AlleleSourceExome), string(store.AlleleSourceGenome):
+						source = store.AlleleSource(c.String("source"))
+					default:
+						return fmt.Errorf("invalid source: %s", c.String("source"))
+					}
+
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					files, err := importer.GnoMADFiles(logger, paths, source)
+					if err != nil {
+						return err
+					}
+
+					joint := slices.ContainsFunc(files, func(paths []string) bool {
+						return len(paths) == 2
+					})
+
+					if joint && c.Bool("joint") {
+						return fmt.Errorf("--joint can't be used when importing both exomes and genomes")
+					}
+
 					dbPath := c.String("db")
 					noSync := c.Bool("no-sync")
 
@@ -143,18 +497,190 @@ func main() {
 					}
 					defer db.Close()
 
-					gnoMADPath := c.Args().First()
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					regions, err := parseRegions(c)
+					if err != nil {
+						return err
+					}
+
 					minimumFrequency := c.Float64("minimum-frequency")
 
-					logger.Info("Adding gnomAD alleles", "path", gnoMADPath, "minimumFrequency", minimumFrequency)
+					opts := importer.GnoMADOptions{
+						MinimumFrequency:    minimumFrequency,
+						ReferenceFASTAPath:  c.String("fasta"),
+						AncestryMappingPath: c.String("ancestry-mapping"),
+						Source:              source,
+						Joint:               c.Bool("joint"),
+						SexSpecific:         c.Bool("sex-specific"),
+						Workers:             c.Int("workers"),
+						Regions:             regions,
+						Strict:              c.Bool("strict"),
+						MaxErrors:           c.Int("max-errors"),
+						Batch:               batchOptions(c),
+					}
+
+					return importFiles(c, st, files, func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						if len(paths) == 2 {
+							exomesPath, genomesPath := paths[0], paths[1]
+
+							logger.Info("Adding joint gnomAD alleles", "exomesPath", exomesPath, "genomesPath", genomesPath, "minimumFrequency", minimumFrequency)
+
+							return importer.GnoMADJoint(ctx, logger, db, st, exomesPath, genomesPath, opts, progress, stats)
+						}
+
+						logger.Info("Adding gnomAD alleles", "path", paths[0], "minimumFrequency", minimumFrequency)
+
+						return importer.GnoMAD(ctx, logger, db, st, paths[0], opts, progress, stats)
+					})
+				},
+			},
+			{
+				Name:      "clinvar",
+				Usage:     "Import ClinVar clinical significance annotations into a Genobase DB",
+				UsageText: "importer clinvar [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <clinvar vcf path or url>...",
+				Flags:     fileFlags,
+				Before:    init,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("missing required clinvar path argument")
+					}
+
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					dbPath := c.String("db")
+					noSync := c.Bool("no-sync")
+
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					return importFiles(c, st, eachFile(paths), func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						logger.Info("Adding ClinVar annotations", "path", paths[0])
 
-					return importer.GnoMAD(c.Context, logger, db, gnoMADPath, minimumFrequency, showProgress)
+						return importer.ClinVar(ctx, logger, st, paths[0], batchOptions(c), progress)
+					})
+				},
+			},
+			{
+				Name:      "gwas",
+				Usage:     "Import GWAS Catalog trait associations into a Genobase DB",
+				UsageText: "importer gwas [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <gwas catalog associations tsv path or url>...",
+				Flags:     fileFlags,
+				Before:    init,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("missing required gwas catalog path argument")
+					}
+
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					dbPath := c.String("db")
+					noSync := c.Bool("no-sync")
+
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					// The associations of every file replace those previously
+					// imported together.
+					return importFiles(c, st, [][]string{paths}, func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						logger.Info("Adding GWAS Catalog associations", "paths", paths)
+
+						return importer.GWAS(ctx, logger, st, paths, batchOptions(c), progress)
+					})
+				},
+			},
+			{
+				Name:      "pgs",
+				Usage:     "Import a PGS Catalog polygenic score into a Genobase DB",
+				UsageText: "importer pgs [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <pgs catalog harmonized scoring file path or url>...",
+				Flags:     fileFlags,
+				Before:    init,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("missing required pgs scoring file path argument")
+					}
+
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					dbPath := c.String("db")
+					noSync := c.Bool("no-sync")
+
+					// Scores are linked against the Genobase variants, so make sure its
+					// schema exists.
+					db, err := genobase.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer db.Close()
+
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					return importFiles(c, st, eachFile(paths), func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						logger.Info("Adding PGS Catalog score", "path", paths[0])
+
+						return importer.PGS(ctx, logger, st, paths[0], batchOptions(c), progress)
+					})
+				},
+			},
+			{
+				Name:      "merged-rsids",
+				Usage:     "Import the dbSNP merge history (so retired RSIDs resolve) into a Genobase DB",
+				UsageText: "importer merged-rsids [--batch-size rows] [--batch-bytes bytes] [--adaptive-batching] [--optimize] [--continue-on-error] <refsnp-merged json or RsMergeArch path or url>...",
+				Flags:     fileFlags,
+				Before:    init,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("missing required merge history path argument")
+					}
+
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					dbPath := c.String("db")
+					noSync := c.Bool("no-sync")
+
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					return importFiles(c, st, eachFile(paths), func(ctx context.Context, paths []string, progress *importer.Progress, stats *importer.Stats) error {
+						logger.Info("Adding dbSNP merge history", "path", paths[0])
+
+						return importer.MergedRSIDs(ctx, logger, st, paths[0], batchOptions(c), progress)
+					})
 				},
 			},
 			{
 				Name:      "chain-file",
 				Usage:     "Import liftOver chain file into a Genobase DB",
-				UsageText: "importer chain-file <-f reference> <chain file path>",
+				UsageText: "importer chain-file <-f reference> <chain file path or url>",
 				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "from",
@@ -162,13 +688,18 @@ func main() {
 						Usage:    "The reference this chain is from (eg. GRCh37)",
 						Required: true,
 					},
-				}, sharedFlags...),
+				}, inputFlags...),
 				Before: init,
 				Action: func(c *cli.Context) error {
 					if c.NArg() != 1 {
 						return fmt.Errorf("missing required chain file path argument")
 					}
 
+					opts, err := filesOptions(c)
+					if err != nil {
+						return err
+					}
+
 					dbPath := c.String("db")
 					noSync := c.Bool("no-sync")
 
@@ -178,27 +709,300 @@ func main() {
 					}
 					defer db.Close()
 
+					st, err := store.Open(c.Context, logger, dbPath, noSync)
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
 					from, err := names.Reference(c.String("from"))
 					if err != nil {
 						return fmt.Errorf("invalid from reference: %w", err)
 					}
 
-					chainFilePath := c.Args().First()
+					paths, err := inputPaths(c, c.Args().Slice())
+					if err != nil {
+						return err
+					}
+
+					if len(paths) != 1 {
+						return fmt.Errorf("expected a single chain file, got %d", len(paths))
+					}
+					chainFilePath := paths[0]
 
 					logger.Info("Adding liftOver chain", "from", from, "path", chainFilePath)
 
-					return importer.LiftOverChain(c.Context, logger, db, from, chainFilePath, showProgress)
+					// Storing the chain file displays its own progress.
+					return importer.ImportFiles(c.Context, logger, st, [][]string{{chainFilePath}}, opts, func(ctx context.Context, paths []string, _ *importer.Stats) error {
+						return importer.LiftOverChain(ctx, logger, db, from, paths[0], showProgress)
+					})
+				},
+			},
+			{
+				Name:      "info",
+				Usage:     "Print the provenance of the data imported into a Genobase DB",
+				UsageText: "importer info",
+				Flags:     sharedFlags,
+				Before:    init,
+				Action: func(c *cli.Context) error {
+					st, err := store.Open(c.Context, logger, c.String("db"), c.Bool("no-sync"))
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					return importer.WriteProvenance(c.Context, st, os.Stdout)
+				},
+			},
+			{
+				Name:      "build",
+				Usage:     "Build a Genobase DB by running the imports declared in a recipe",
+				UsageText: "importer build [--force] [--optimize] <recipe yaml path>",
+				Description: "A recipe lists the import steps to run, in order, each with its files (paths or glob\n" +
+					"patterns relative to the recipe, or URLs) and command options, eg.\n\n" +
+					"  steps:\n" +
+					"    - import: alleles\n" +
+					"      files: [gnomad.exomes.*.vcf.bgz, gnomad.genomes.*.vcf.bgz]\n" +
+					"    - import: variants\n" +
+					"      files: [GCF_000001405.40.gz]\n" +
+					"      options:\n" +
+					"        known: true\n\n" +
+					"Steps whose files have already been imported with the same options are skipped, unless a\n" +
+					"step they depend on (eg. alleles, for known variants) is run.",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Run every step, even if its files haven't changed",
+						Value: false,
+					},
+					optimizeFlag,
+					cacheDirFlag,
+				}, sharedFlags...),
+				Before: init,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("missing required recipe path argument")
+					}
+
+					recipe, err := importer.ReadRecipe(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					// Download any remote files (or check the cached copies are
+					// still current).
+					for _, step := range recipe.Steps {
+						step.Paths, err = inputPaths(c, step.Paths)
+						if err != nil {
+							return fmt.Errorf("step %s: %w", step.Name, err)
+						}
+					}
+
+					st, err := store.Open(c.Context, logger, c.String("db"), c.Bool("no-sync"))
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					// Every step is run with the same shared flags as the build.
+					sharedArgs := []string{
+						"--log-level=" + fmt.Sprint(c.Generic("log-level")),
+						"--show-progress=" + fmt.Sprint(c.Bool("show-progress")),
+						"--db=" + c.String("db"),
+						"--no-sync=" + fmt.Sprint(c.Bool("no-sync")),
+					}
+
+					opts := importer.BuildOptions{
+						Force: c.Bool("force"),
+						Options: func(step *importer.RecipeStep) (map[string]string, error) {
+							cmd := c.App.Command(step.Import)
+							if cmd == nil || !slices.Contains(recipeImports, cmd.Name) {
+								return nil, fmt.Errorf("unknown import: %s", step.Import)
+							}
+
+							for _, f := range sharedFlags {
+								if _, ok := step.Options[f.Names()[0]]; ok {
+									return nil, fmt.Errorf("%s must be set for the whole build, not per step", f.Names()[0])
+								}
+							}
+
+							return stepOptions(c, cmd, step.Flags(), inputFlags)
+						},
+					}
+
+					logger.Info("Building database", "recipe", c.Args().First(), "version", importer.Version())
+
+					err = importer.Build(c.Context, logger, st, recipe, opts, func(ctx context.Context, step *importer.RecipeStep) error {
+						args := append([]string{c.App.Name, step.Import}, sharedArgs...)
+						args = append(args, step.Flags()...)
+						args = append(args, "--")
+						args = append(args, step.Paths...)
+
+						return c.App.RunContext(ctx, args)
+					})
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("optimize") {
+						return importer.Optimize(c.Context, logger, st, c.String("db"), importer.OptimizeOptions{})
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "optimize",
+				Usage:     "Build indexes, analyze and vacuum a Genobase DB (eg. before distributing it)",
+				UsageText: "importer optimize [--no-vacuum | --vacuum-into path]",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-vacuum",
+						Usage: "Rebuild the indexes in place, rather than vacuuming the database",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "vacuum-into",
+						Usage: "Write the optimized database to a new file, leaving the original as is",
+					},
+				}, sharedFlags...),
+				Before: init,
+				Action: func(c *cli.Context) error {
+					st, err := store.Open(c.Context, logger, c.String("db"), c.Bool("no-sync"))
+					if err != nil {
+						return fmt.Errorf("could not open database: %w", err)
+					}
+					defer st.Close()
+
+					return importer.Optimize(c.Context, logger, st, c.String("db"), importer.OptimizeOptions{
+						NoVacuum:   c.Bool("no-vacuum"),
+						VacuumInto: c.String("vacuum-into"),
+					})
 				},
 			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Restore the default behavior once interrupted, so a second signal exits
+	// immediately.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if ctx.Err() != nil {
+			logger.Warn("Import interrupted", "error", err)
+			os.Exit(exitInterrupted)
+		}
+
 		logger.Error("Error running app", "error", err)
 		os.Exit(1)
 	}
 }
 
+// parseRegions returns the regions given by the --region and --regions-file
+// flags.
+func parseRegions(c *cli.Context) ([]importer.Region, error) {
+	var regions []importer.Region
+	for _, s := range c.StringSlice("region") {
+		region, err := importer.ParseRegion(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid region: %w", err)
+		}
+
+		regions = append(regions, region)
+	}
+
+	if path := c.String("regions-file"); path != "" {
+		fileRegions, err := importer.ReadRegionsFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fileRegions) == 0 {
+			return nil, fmt.Errorf("no regions in regions file: %s", path)
+		}
+
+		regions = append(regions, fileRegions...)
+	}
+
+	return regions, nil
+}
+
+// commandOptions returns the values of the options of a command (other than
+// the given shared flags), for recording in the provenance of an import.
+func commandOptions(c *cli.Context, sharedFlags []cli.Flag) map[string]string {
+	shared := make(map[string]bool)
+	for _, flag := range sharedFlags {
+		shared[flag.Names()[0]] = true
+	}
+
+	options := make(map[string]string)
+	for _, flag := range c.Command.Flags {
+		name := flag.Names()[0]
+		if shared[name] || flag == cli.HelpFlag {
+			continue
+		}
+
+		switch flag.(type) {
+		case *cli.StringSliceFlag:
+			options[name] = strings.Join(c.StringSlice(name), ",")
+		default:
+			options[name] = fmt.Sprint(c.Value(name))
+		}
+	}
+
+	return options
+}
+
+// The commands that can be run as steps of a recipe.
+var recipeImports = []string{"variants", "alleles", "clinvar", "gwas", "pgs", "merged-rsids", "chain-file"}
+
+// Options that don't change what is imported, so aren't compared when
+// deciding whether a recipe step has changed.
+var runtimeOptions = []string{"workers", "resume", "continue-on-error", "rejects", "strict", "max-errors",
+	"batch-size", "batch-bytes", "adaptive-batching", "optimize", "drop-indexes"}
+
+// stepOptions returns the options of a recipe step as they would be recorded
+// in the provenance of its import (other than the runtime options).
+func stepOptions(c *cli.Context, cmd *cli.Command, flags []string, sharedFlags []cli.Flag) (map[string]string, error) {
+	set := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	for _, f := range cmd.Flags {
+		if err := f.Apply(set); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := set.Parse(flags); err != nil {
+		return nil, err
+	}
+
+	stepCtx := cli.NewContext(c.App, set, c)
+	stepCtx.Command = cmd
+
+	options := commandOptions(stepCtx, sharedFlags)
+	for _, name := range runtimeOptions {
+		delete(options, name)
+	}
+
+	return options, nil
+}
+
+// eachFile returns the given files, to be imported one at a time.
+func eachFile(paths []string) [][]string {
+	files := make([][]string, len(paths))
+	for i, path := range paths {
+		files[i] = []string{path}
+	}
+
+	return files
+}
+
 type logLevelFlag slog.Level
 
 func fromLogLevel(l slog.Level) *logLevelFlag {